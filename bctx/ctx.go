@@ -1,13 +1,14 @@
 package bctx
 
 import (
-	"fmt"
 	"log"
-	"strconv"
+	"sync"
 
 	"github.com/dbolotin/deadmanswitch/comm"
+	"github.com/dbolotin/deadmanswitch/funcs"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
 )
 
 type ChannelPointer struct {
@@ -28,16 +29,51 @@ func (c ChannelPointer) RecvCh(env *BEnv) <-chan comm.Msg {
 
 type BEnv struct {
 	DefaultVariables map[string]cty.Value
-	dw               hcl.DiagnosticWriter
-	channels         map[string]chan comm.Msg
-	i                uint64
+	// Functions of expressions evaluated when the config is loaded
+	Functions map[string]function.Function
+	// Functions of expressions evaluated for each message
+	MessageFunctions map[string]function.Function
+	*shared
+}
+
+// State shared by the main context and all contexts derived from it
+type shared struct {
+	dw           hcl.DiagnosticWriter
+	dwLock       sync.Mutex
+	channels     map[string]chan comm.Msg
+	channelsLock sync.Mutex
+	// Nil if state isn't persisted
+	stateStore     *StateStore
+	stateStoreLock sync.Mutex
 }
 
 func NewCtx(dw hcl.DiagnosticWriter) *BEnv {
 	return &BEnv{
 		DefaultVariables: make(map[string]cty.Value),
-		dw:               dw,
-		channels:         make(map[string]chan comm.Msg),
+		Functions:        funcs.ConfigFunctions(),
+		MessageFunctions: funcs.Functions(),
+		shared: &shared{
+			dw:       dw,
+			channels: make(map[string]chan comm.Msg),
+		},
+	}
+}
+
+// WithVariables derives a context with additional default variables. Derived context shares
+// communication channels and diagnostics output with the original one.
+func (ctx *BEnv) WithVariables(vars map[string]cty.Value) *BEnv {
+	variables := make(map[string]cty.Value)
+	for k, v := range ctx.DefaultVariables {
+		variables[k] = v
+	}
+	for k, v := range vars {
+		variables[k] = v
+	}
+	return &BEnv{
+		DefaultVariables: variables,
+		Functions:        ctx.Functions,
+		MessageFunctions: ctx.MessageFunctions,
+		shared:           ctx.shared,
 	}
 }
 
@@ -47,6 +83,7 @@ func (ctx *BEnv) DefaultEvaluationContext(msg *comm.Msg) *hcl.EvalContext {
 		Variables: map[string]cty.Value{
 			"msg": msg.Value(),
 		},
+		Functions: ctx.MessageFunctions,
 	}
 
 	// Adding default variables
@@ -57,42 +94,6 @@ func (ctx *BEnv) DefaultEvaluationContext(msg *comm.Msg) *hcl.EvalContext {
 	return evCtx
 }
 
-func (ctx *BEnv) StartProcessing(msgCh <-chan comm.Msg, handler func(msg comm.Msg) error) {
-	go func() {
-		for m := range msgCh {
-			// Saving msg to a separate variable to use it in a forked goroutine
-			// Important: "m" must not be used
-			msg := m
-
-			// Each request processed in a separate goroutine
-			go func() {
-				// Handling panics
-				defer func() {
-					if r := recover(); r != nil {
-						ctx.WriteError(fmt.Errorf("%s", r))
-						msg.ReplyWithError()
-					}
-				}()
-
-				// Executing main handler
-				err := handler(msg)
-
-				if err != nil {
-					// Reply with error
-					ctx.WriteError(err)
-					msg.ReplyWithError()
-				} else {
-					// Ensure message reply channel is closed
-					msg.Close()
-				}
-			}()
-		}
-
-		// Should never reach this statement
-		log.Fatalln("Communication channel closed.")
-	}()
-}
-
 func EvaluateExpression(expr hcl.Expression, ctx *hcl.EvalContext) (cty.Value, error) {
 	value, diag := expr.Value(ctx)
 	if diag.HasErrors() || !value.IsWhollyKnown() {
@@ -101,12 +102,10 @@ func EvaluateExpression(expr hcl.Expression, ctx *hcl.EvalContext) (cty.Value, e
 	return value, nil
 }
 
-func (ctx *BEnv) nextChId() string {
-	ctx.i++
-	return "ch" + strconv.FormatUint(ctx.i, 10)
-}
-
 func (ctx *BEnv) channel(id string) chan comm.Msg {
+	ctx.channelsLock.Lock()
+	defer ctx.channelsLock.Unlock()
+
 	channel, ok := ctx.channels[id]
 	if !ok {
 		panic("Communication channel with such id not registered: " + id)
@@ -115,12 +114,53 @@ func (ctx *BEnv) channel(id string) chan comm.Msg {
 	}
 }
 
-// Registers channel and returns its id
-func (ctx *BEnv) NewChannel() *ChannelPointer {
-	ch := make(chan comm.Msg, 1) // 1 -> Safer in terms of stupid deadlocks
-	id := ctx.nextChId()
-	ctx.channels[id] = ch
-	return &ChannelPointer{Id: id}
+// Registers input channel of the block with the given id (if not yet registered) and
+// returns pointer to it. Channel outlives the block instance, so a block re-created on
+// config reload keeps receiving messages from unchanged upstream blocks.
+func (ctx *BEnv) Channel(blockId string) *ChannelPointer {
+	ctx.channelsLock.Lock()
+	defer ctx.channelsLock.Unlock()
+
+	if _, ok := ctx.channels[blockId]; !ok {
+		ctx.channels[blockId] = make(chan comm.Msg, 1) // 1 -> Safer in terms of stupid deadlocks
+	}
+	return &ChannelPointer{Id: blockId}
+}
+
+// Unregisters channels of all blocks except the given ones
+func (ctx *BEnv) RetainChannels(blockIds map[string]bool) {
+	ctx.channelsLock.Lock()
+	defer ctx.channelsLock.Unlock()
+
+	for id := range ctx.channels {
+		if !blockIds[id] {
+			delete(ctx.channels, id)
+		}
+	}
+}
+
+// SetStateStore sets the store blocks persist their state to, nil disables persistence
+func (ctx *BEnv) SetStateStore(store *StateStore) {
+	ctx.stateStoreLock.Lock()
+	defer ctx.stateStoreLock.Unlock()
+
+	ctx.stateStore = store
+}
+
+// StateStore returns the store blocks persist their state to, nil if state isn't persisted
+func (ctx *BEnv) StateStore() *StateStore {
+	ctx.stateStoreLock.Lock()
+	defer ctx.stateStoreLock.Unlock()
+
+	return ctx.stateStore
+}
+
+// Replaces diagnostics writer, e.g. to make it aware of re-parsed config files
+func (ctx *BEnv) SetDiagnosticWriter(dw hcl.DiagnosticWriter) {
+	ctx.dwLock.Lock()
+	defer ctx.dwLock.Unlock()
+
+	ctx.dw = dw
 }
 
 func (ctx *BEnv) WriteError(err error) {
@@ -133,7 +173,10 @@ func (ctx *BEnv) WriteError(err error) {
 }
 
 func (ctx *BEnv) WriteDiagnostic(diagnostic *hcl.Diagnostic) {
-	// TODO synchronize, limit rate, monitoring
+	// TODO limit rate, monitoring
+	ctx.dwLock.Lock()
+	defer ctx.dwLock.Unlock()
+
 	err := ctx.dw.WriteDiagnostic(diagnostic)
 	if err != nil {
 		log.Fatalln(err)
@@ -141,7 +184,10 @@ func (ctx *BEnv) WriteDiagnostic(diagnostic *hcl.Diagnostic) {
 }
 
 func (ctx *BEnv) WriteDiagnostics(diagnostics hcl.Diagnostics) {
-	// TODO synchronize, limit rate, monitoring
+	// TODO limit rate, monitoring
+	ctx.dwLock.Lock()
+	defer ctx.dwLock.Unlock()
+
 	err := ctx.dw.WriteDiagnostics(diagnostics)
 	if err != nil {
 		log.Fatalln(err)
@@ -0,0 +1,77 @@
+package bctx
+
+import (
+	"context"
+	"sync"
+)
+
+// Lifecycle signals background goroutines of a block that the block is being stopped, and
+// tracks goroutines processing messages, so the block can be stopped gracefully
+type Lifecycle struct {
+	initOnce sync.Once
+	stopOnce sync.Once
+	done     chan struct{}
+	inFlight sync.WaitGroup
+
+	cleanupLock sync.Mutex
+	cleanup     []func()
+}
+
+func (l *Lifecycle) init() {
+	l.initOnce.Do(func() {
+		l.done = make(chan struct{})
+	})
+}
+
+// Done returns a channel that is closed when the block is requested to stop
+func (l *Lifecycle) Done() <-chan struct{} {
+	l.init()
+	return l.done
+}
+
+// Go runs the function in a separate goroutine, that Stop waits for
+func (l *Lifecycle) Go(f func()) {
+	l.inFlight.Add(1)
+	go func() {
+		defer l.inFlight.Done()
+		f()
+	}()
+}
+
+// AfterStop registers the function to be run once the block is stopped and all its goroutines
+// completed, e.g. to delete metrics of the block. It is not run if the goroutines don't complete
+// in time, as a replacement block with the same id may already be using the same resources.
+func (l *Lifecycle) AfterStop(f func()) {
+	l.cleanupLock.Lock()
+	defer l.cleanupLock.Unlock()
+	l.cleanup = append(l.cleanup, f)
+}
+
+// Stop requests all goroutines watching Done to terminate and waits for goroutines started
+// with Go to complete, until the context is done
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.init()
+	l.stopOnce.Do(func() {
+		close(l.done)
+	})
+
+	completed := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(completed)
+	}()
+
+	select {
+	case <-completed:
+		l.cleanupLock.Lock()
+		cleanup := l.cleanup
+		l.cleanup = nil
+		l.cleanupLock.Unlock()
+		for _, f := range cleanup {
+			f()
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,198 @@
+package bctx
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/dbolotin/deadmanswitch/comm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// What to do with a message arriving when all workers are busy and the queue is full
+type Overflow string
+
+const (
+	// Stop receiving messages, making upstream blocks wait
+	OverflowBlock Overflow = "block"
+	// Discard the oldest queued message, replying to it with an error
+	OverflowDropOldest Overflow = "drop_oldest"
+	// Discard the arriving message, replying to it with an error
+	OverflowReject Overflow = "reject"
+)
+
+// Overflows lists all supported overflow policies
+var Overflows = []Overflow{OverflowBlock, OverflowDropOldest, OverflowReject}
+
+// Validate checks that the overflow policy is supported
+func (o Overflow) Validate() error {
+	var supported []string
+	for _, s := range Overflows {
+		if o == s {
+			return nil
+		}
+		supported = append(supported, string(s))
+	}
+	return fmt.Errorf("unknown overflow policy %q; supported policies are: %s", o, strings.Join(supported, ", "))
+}
+
+// ProcessingOptions limits the number of messages a block processes simultaneously
+type ProcessingOptions struct {
+	// Number of messages processed simultaneously; unlimited if zero
+	Concurrency int
+	// Number of messages waiting for a free worker
+	QueueSize int
+	Overflow  Overflow
+}
+
+var (
+	processingQueueDepthVec = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "processing_queue_depth"}, []string{"block"})
+	processingInFlightVec   = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "processing_in_flight"}, []string{"block"})
+	processingOverflowsVec  = promauto.NewCounterVec(prometheus.CounterOpts{Name: "processing_overflows"}, []string{"block", "overflow"})
+)
+
+// StartProcessing handles messages from the channel, each in a separate goroutine, until the
+// block is stopped. Messages already queued when the block is stopped are still processed.
+func (ctx *BEnv) StartProcessing(lc *Lifecycle, blockId string, msgCh <-chan comm.Msg, opts ProcessingOptions,
+	handler func(msg comm.Msg) error) {
+
+	// Monitoring
+	pLabels := prometheus.Labels{
+		"block": blockId,
+	}
+	mQueueDepth := processingQueueDepthVec.With(pLabels)
+	mInFlight := processingInFlightVec.With(pLabels)
+	mOverflows := processingOverflowsVec.With(prometheus.Labels{
+		"block":    blockId,
+		"overflow": string(opts.Overflow),
+	})
+	lc.AfterStop(func() {
+		processingQueueDepthVec.Delete(pLabels)
+		processingInFlightVec.Delete(pLabels)
+		processingOverflowsVec.Delete(prometheus.Labels{
+			"block":    blockId,
+			"overflow": string(opts.Overflow),
+		})
+	})
+
+	// Discarded messages are replied with an error, so upstream doesn't take them as processed
+	reject := func(msg comm.Msg, message string) {
+		err := comm.Errorf(comm.ErrorRejected, message)
+		err.Block = blockId
+		msg.ReplyWithError(err)
+	}
+
+	// Notifications of workers about completed messages; never blocking the workers
+	completed := make(chan struct{}, opts.Concurrency)
+
+	process := func(msg comm.Msg) {
+		mInFlight.Inc()
+
+		// Each request processed in a separate goroutine
+		lc.Go(func() {
+			defer func() {
+				mInFlight.Dec()
+				if opts.Concurrency != 0 {
+					completed <- struct{}{}
+				}
+			}()
+
+			// Handling panics
+			defer func() {
+				if r := recover(); r != nil {
+					err := fmt.Errorf("%s", r)
+					ctx.WriteError(err)
+					msg.ReplyWithError(comm.AsError(blockId, err))
+				}
+			}()
+
+			// Executing main handler
+			err := handler(msg)
+
+			if err != nil {
+				// Reply with error
+				ctx.WriteError(err)
+				msg.ReplyWithError(comm.AsError(blockId, err))
+			} else {
+				// Ensure message reply channel is closed
+				msg.Close()
+			}
+		})
+	}
+
+	lc.Go(func() {
+		var queue []comm.Msg
+		active := 0
+		stopping := false
+		done := lc.Done()
+
+		// Accepts a message, starting its processing right away if there is a free worker
+		accept := func(msg comm.Msg) {
+			if opts.Concurrency == 0 || active < opts.Concurrency {
+				active++
+				process(msg)
+				return
+			}
+			if len(queue) < opts.QueueSize || stopping {
+				queue = append(queue, msg)
+				return
+			}
+
+			// Only policies discarding messages get here, as blocking policy stops receiving
+			mOverflows.Inc()
+			if opts.Overflow == OverflowDropOldest && len(queue) != 0 {
+				reject(queue[0], "message dropped from the full queue")
+				queue = append(queue[1:], msg)
+				return
+			}
+			reject(msg, "queue is full")
+		}
+
+		for {
+			mQueueDepth.Set(float64(len(queue)))
+
+			if stopping && len(queue) == 0 {
+				return
+			}
+
+			// Receiving messages only while there is room for them, unless they may be discarded
+			input := msgCh
+			if stopping || opts.Concurrency != 0 && active >= opts.Concurrency &&
+				len(queue) >= opts.QueueSize && opts.Overflow == OverflowBlock {
+				input = nil
+			}
+
+			select {
+			case <-done:
+				// Block stopped; draining the queue, messages sent later are left to its successor
+				stopping = true
+				done = nil
+				for drained := false; !drained; {
+					select {
+					case msg := <-msgCh:
+						accept(msg)
+					default:
+						drained = true
+					}
+				}
+
+			case msg, ok := <-input:
+				if !ok {
+					// Should never happen
+					log.Fatalln("Communication channel closed.")
+				}
+				accept(msg)
+
+			case <-completed:
+				active--
+				if len(queue) != 0 {
+					msg := queue[0]
+					queue = queue[1:]
+					active++
+					process(msg)
+				}
+			}
+		}
+	})
+}
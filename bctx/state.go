@@ -0,0 +1,131 @@
+package bctx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Version of the state file format
+const stateVersion = 1
+
+// StateStore keeps state of blocks in a JSON file, so it survives restarts
+type StateStore struct {
+	path   string
+	lock   sync.Mutex
+	blocks map[string]json.RawMessage
+}
+
+type stateFile struct {
+	Version int                        `json:"version"`
+	Blocks  map[string]json.RawMessage `json:"blocks"`
+}
+
+// OpenStateStore reads the state file, starting with empty state if it doesn't exist yet
+func OpenStateStore(path string) (*StateStore, error) {
+	s := &StateStore{
+		path:   path,
+		blocks: make(map[string]json.RawMessage),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f stateFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("malformed state file %s: %s", path, err)
+	}
+	if f.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported version %d of state file %s", f.Version, path)
+	}
+	if f.Blocks != nil {
+		s.blocks = f.Blocks
+	}
+	return s, nil
+}
+
+func (s *StateStore) Path() string {
+	return s.path
+}
+
+// Load reads saved state of the block into v; returns false if there is none
+func (s *StateStore) Load(blockId string, v interface{}) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, ok := s.blocks[blockId]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Save replaces state of the block and writes the file
+func (s *StateStore) Save(blockId string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.blocks[blockId] = data
+	return s.write()
+}
+
+// Retain drops state of all blocks except the given ones
+func (s *StateStore) Retain(blockIds map[string]bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	changed := false
+	for id := range s.blocks {
+		if !blockIds[id] {
+			delete(s.blocks, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.write()
+}
+
+// write replaces the file atomically, so it's never left partially written
+func (s *StateStore) write() error {
+	data, err := json.MarshalIndent(stateFile{Version: stateVersion, Blocks: s.blocks}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -2,6 +2,8 @@ package blocks
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/dbolotin/deadmanswitch/bctx"
 	"github.com/dbolotin/deadmanswitch/comm"
@@ -12,11 +14,34 @@ import (
 type Block interface {
 	GetValue(env *bctx.BEnv) cty.Value
 	Start(env *bctx.BEnv) error
+	Stop(ctx context.Context) error
 	SetId(id string)
 	GetId() string
 }
 
+// Block receiving messages from other blocks
+type InputBlock interface {
+	Block
+	Ch0(env *bctx.BEnv) <-chan comm.Msg
+}
+
+// Validator is implemented by blocks able to check their configuration before being started
+type Validator interface {
+	Validate() []error
+}
+
+// AttrError is a configuration problem related to a particular attribute of a block
+type AttrError struct {
+	Attr string
+	Err  error
+}
+
+func (e *AttrError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Attr, e.Err)
+}
+
 type ABlock struct {
+	bctx.Lifecycle
 	Id string
 }
 
@@ -43,7 +68,7 @@ type SingleChannelBlock struct {
 
 func (b *SingleChannelBlock) GetValue(env *bctx.BEnv) cty.Value {
 	if b.ICh0 == nil {
-		b.ICh0 = env.NewChannel()
+		b.ICh0 = env.Channel(b.Id)
 	}
 	return b.ICh0.ToCty()
 }
@@ -52,6 +77,21 @@ func (b *SingleChannelBlock) Ch0(ctx *bctx.BEnv) <-chan comm.Msg {
 	return b.ICh0.RecvCh(ctx)
 }
 
+// ProcessingBlock handles each message in a separate goroutine, possibly with limited concurrency
+type ProcessingBlock struct {
+	SingleChannelBlock
+	Processing bctx.ProcessingOptions
+}
+
+// Processor is implemented by blocks accepting processing limits
+type Processor interface {
+	SetProcessingOptions(opts bctx.ProcessingOptions)
+}
+
+func (b *ProcessingBlock) SetProcessingOptions(opts bctx.ProcessingOptions) {
+	b.Processing = opts
+}
+
 func StrOrDefault(str *string, def string) string {
 	if str == nil {
 		return def
@@ -100,6 +140,14 @@ func Int32OrDefault(str *int32, def int32) int32 {
 	}
 }
 
+func DurationOrDefault(str *string, def time.Duration) (time.Duration, error) {
+	if str == nil {
+		return def, nil
+	} else {
+		return time.ParseDuration(*str)
+	}
+}
+
 type sendRequest struct {
 	ctx    context.Context
 	sendTo chan<- comm.Msg
@@ -112,7 +160,9 @@ type sendResult struct {
 	result   cty.Value
 }
 
-func sendAll(terminateOnError bool, requests []sendRequest) (cty.Value, bool) {
+// sendAll sends the values and collects replies into the "results" tuple. If any of the
+// deliveries fails, reply of the block is an error caused by the failed deliveries.
+func sendAll(blockId string, terminateOnError bool, requests []sendRequest) (cty.Value, bool) {
 	count := len(requests)
 	resultChannel := make(chan sendResult, count)
 	results := make([]cty.Value, count)
@@ -135,7 +185,7 @@ func sendAll(terminateOnError bool, requests []sendRequest) (cty.Value, bool) {
 		v.sendTo <- m
 	}
 
-	hasErrors := false
+	var causes []*comm.Error
 	for n := 0; n < count; n++ {
 		r := <-resultChannel
 		if r.hasReply {
@@ -143,8 +193,8 @@ func sendAll(terminateOnError bool, requests []sendRequest) (cty.Value, bool) {
 		} else {
 			results[r.i] = ctyutil.StrNullVal
 		}
-		if comm.IsErrorReply(r.result) {
-			hasErrors = true
+		if err := comm.ErrorFromReply(r.result); err != nil {
+			causes = append(causes, err)
 			if terminateOnError {
 				break
 			}
@@ -155,9 +205,13 @@ func sendAll(terminateOnError bool, requests []sendRequest) (cty.Value, bool) {
 		"results": cty.TupleVal(results),
 	}
 
-	if hasErrors {
-		retMap["err"] = ctyutil.StrNullVal
+	if len(causes) != 0 {
+		// Failure of the first delivery determines the kind of the error
+		err := comm.Errorf(causes[0].Kind, "%d of %d deliveries failed", len(causes), count)
+		err.Block = blockId
+		err.Causes = causes
+		retMap["err"] = err.Value()
 	}
 
-	return cty.ObjectVal(retMap), hasErrors
+	return cty.ObjectVal(retMap), len(causes) != 0
 }
@@ -2,6 +2,7 @@ package blocks
 
 import (
 	"github.com/dbolotin/deadmanswitch/bctx"
+	"github.com/dbolotin/deadmanswitch/comm"
 	"github.com/dbolotin/deadmanswitch/ctyutil"
 )
 
@@ -15,9 +16,16 @@ func (d *Deduplicate) Start(env *bctx.BEnv) error {
 	sendTo := d.SendTo.SendCh(env)
 	ch0 := d.Ch0(env)
 
-	go func() {
+	d.Go(func() {
 		var previous = ctyutil.StrNullVal
-		for msg := range ch0 {
+		for {
+			var msg comm.Msg
+			select {
+			case <-d.Done():
+				return
+			case msg = <-ch0:
+			}
+
 			current := msg.Value()
 			if previous.RawEquals(current) {
 				msg.Close()
@@ -27,7 +35,7 @@ func (d *Deduplicate) Start(env *bctx.BEnv) error {
 				previous = current
 			}
 		}
-	}()
+	})
 
 	return nil
 }
@@ -0,0 +1,58 @@
+package blocks
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/json"
+)
+
+// Converts a value to the bytes of a http body
+type BodySerializer func(value cty.Value) ([]byte, error)
+
+// NewBodySerializer returns serializer and content type for one of the supported
+// encodings: "json" (default), "url" / "urlencoded" or "raw"
+func NewBodySerializer(encoding string) (BodySerializer, string, error) {
+	if encoding == "" || encoding == "json" {
+		return func(value cty.Value) ([]byte, error) {
+			marshal, err := json.Marshal(value, value.Type())
+			return marshal, err
+		}, "application/json", nil
+	} else if encoding == "urlencoded" || encoding == "url" {
+		return func(value cty.Value) (res []byte, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%s", r)
+				}
+			}()
+
+			if !value.Type().IsObjectType() && !value.Type().IsMapType() {
+				return nil, errors.New("can't decode the value as urlencoded string")
+			}
+
+			data := url.Values{}
+			for k, v := range value.AsValueMap() {
+				vv, err := convert.Convert(v, cty.String)
+				if err != nil {
+					return nil, err
+				}
+				data.Add(k, vv.AsString())
+			}
+			return []byte(data.Encode()), nil
+		}, "application/x-www-form-urlencoded", nil
+	} else if encoding == "raw" {
+		return func(value cty.Value) (res []byte, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%s", r)
+				}
+			}()
+			return []byte(value.AsString()), nil
+		}, "text/plain", nil
+	} else {
+		return nil, "", errors.New("unknown encoding \"" + encoding + "\"")
+	}
+}
@@ -0,0 +1,243 @@
+package blocks
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth restricts access to the endpoint; request is accepted if it passes any of the
+// configured methods
+type Auth struct {
+	Basic  *AuthBasic  `hcl:"basic,block"`
+	Bearer *AuthBearer `hcl:"bearer,block"`
+	APIKey *AuthAPIKey `hcl:"api_key,block"`
+}
+
+// AuthBasic checks user and password against bcrypt hashes
+type AuthBasic struct {
+	// Password hashes by user name
+	Users *map[string]string `hcl:"users,optional"`
+	// File with "user:hash" lines, as created by "htpasswd -B"
+	HtpasswdFile *string `hcl:"htpasswd_file,optional"`
+	Realm        *string `hcl:"realm,optional"`
+}
+
+// AuthBearer checks "Authorization: Bearer <token>" header
+type AuthBearer struct {
+	Tokens *[]string `hcl:"tokens,optional"`
+	// File with a token per line
+	TokensFile *string `hcl:"tokens_file,optional"`
+}
+
+// AuthAPIKey checks key given in a header or in a query parameter
+type AuthAPIKey struct {
+	Header *string   `hcl:"header,optional"`
+	Query  *string   `hcl:"query,optional"`
+	Keys   *[]string `hcl:"keys,optional"`
+	// File with a key per line
+	KeysFile *string `hcl:"keys_file,optional"`
+}
+
+// Checks credentials of the request
+type authenticator func(r *http.Request) bool
+
+// Secrets are compared by their hashes, so comparison time doesn't depend on their lengths
+type secretSet [][sha256.Size]byte
+
+func newSecretSet(secrets []string) secretSet {
+	var result secretSet
+	for _, s := range secrets {
+		result = append(result, sha256.Sum256([]byte(s)))
+	}
+	return result
+}
+
+// contains compares the value with all secrets in constant time
+func (s secretSet) contains(value string) bool {
+	given := sha256.Sum256([]byte(value))
+	found := 0
+	for _, secret := range s {
+		found |= subtle.ConstantTimeCompare(given[:], secret[:])
+	}
+	return found == 1
+}
+
+// Reads non-empty lines of the file
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			result = append(result, line)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// Collects secrets given inline and in the file
+func loadSecrets(inline *[]string, file *string) (secretSet, error) {
+	var secrets []string
+	if inline != nil {
+		secrets = append(secrets, *inline...)
+	}
+	if file != nil {
+		lines, err := readLines(*file)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, lines...)
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no secrets configured")
+	}
+	return newSecretSet(secrets), nil
+}
+
+// Hash compared with the password of unknown users, so they take as long to check as known ones
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+func getDummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+func (a *AuthBasic) newAuthenticator() (authenticator, error) {
+	hashes := make(map[string][]byte)
+	if a.Users != nil {
+		for user, hash := range *a.Users {
+			hashes[user] = []byte(hash)
+		}
+	}
+	if a.HtpasswdFile != nil {
+		lines, err := readLines(*a.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			pair := strings.SplitN(line, ":", 2)
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("malformed line in %s", *a.HtpasswdFile)
+			}
+			hashes[pair[0]] = []byte(pair[1])
+		}
+	}
+	if len(hashes) == 0 {
+		return nil, errors.New("no users configured")
+	}
+	for user, hash := range hashes {
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("password of user %s is not a bcrypt hash", user)
+		}
+	}
+
+	return func(r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return false
+		}
+		hash, known := hashes[user]
+		if !known {
+			hash = getDummyHash()
+		}
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && known
+	}, nil
+}
+
+func (a *AuthBearer) newAuthenticator() (authenticator, error) {
+	tokens, err := loadSecrets(a.Tokens, a.TokensFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(r *http.Request) bool {
+		header := r.Header.Get("Authorization")
+		if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+			return false
+		}
+		return tokens.contains(strings.TrimSpace(header[7:]))
+	}, nil
+}
+
+func (a *AuthAPIKey) newAuthenticator() (authenticator, error) {
+	if (a.Header == nil) == (a.Query == nil) {
+		return nil, errors.New("exactly one of header or query must be set")
+	}
+	keys, err := loadSecrets(a.Keys, a.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(r *http.Request) bool {
+		var key string
+		if a.Header != nil {
+			key = r.Header.Get(*a.Header)
+		} else {
+			key = r.URL.Query().Get(*a.Query)
+		}
+		return key != "" && keys.contains(key)
+	}, nil
+}
+
+// newAuthenticator creates authenticator accepting requests that pass any of the configured
+// methods, and the WWW-Authenticate challenge for rejected requests
+func (a *Auth) newAuthenticator() (authenticator, string, error) {
+	var methods []authenticator
+	var challenge string
+
+	if a.APIKey != nil {
+		m, err := a.APIKey.newAuthenticator()
+		if err != nil {
+			return nil, "", fmt.Errorf("api_key: %s", err)
+		}
+		methods = append(methods, m)
+	}
+	if a.Bearer != nil {
+		m, err := a.Bearer.newAuthenticator()
+		if err != nil {
+			return nil, "", fmt.Errorf("bearer: %s", err)
+		}
+		methods = append(methods, m)
+		challenge = "Bearer"
+	}
+	if a.Basic != nil {
+		m, err := a.Basic.newAuthenticator()
+		if err != nil {
+			return nil, "", fmt.Errorf("basic: %s", err)
+		}
+		methods = append(methods, m)
+		challenge = fmt.Sprintf("Basic realm=%q", StrOrDefault(a.Basic.Realm, "hookblock"))
+	}
+	if len(methods) == 0 {
+		return nil, "", errors.New("no authentication methods configured")
+	}
+
+	return func(r *http.Request) bool {
+		for _, m := range methods {
+			if m(r) {
+				return true
+			}
+		}
+		return false
+	}, challenge, nil
+}
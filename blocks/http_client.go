@@ -0,0 +1,102 @@
+package blocks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// HttpClient configures connections of the http_request block
+type HttpClient struct {
+	// CA bundle to verify server certificates with, instead of the system one
+	CAFile *string `hcl:"ca_file,optional"`
+	// Client certificate, presented to servers requiring mutual TLS
+	CertFile           *string `hcl:"cert_file,optional"`
+	KeyFile            *string `hcl:"key_file,optional"`
+	InsecureSkipVerify bool    `hcl:"insecure_skip_verify,optional"`
+
+	// Proxy URL; proxy is taken from HTTP_PROXY / HTTPS_PROXY environment variables if unset,
+	// empty string disables proxying
+	Proxy *string `hcl:"proxy,optional"`
+
+	MaxIdleConns        *int    `hcl:"max_idle_conns,optional"`
+	MaxIdleConnsPerHost *int    `hcl:"max_idle_conns_per_host,optional"`
+	IdleConnTimeout     *string `hcl:"idle_conn_timeout,optional"`
+	DisableKeepAlives   bool    `hcl:"disable_keep_alives,optional"`
+
+	// Number of redirects to follow, 10 by default; redirect response is returned as is when
+	// the limit is reached
+	MaxRedirects *int `hcl:"max_redirects,optional"`
+}
+
+// newHttpClient creates client of a http_request block; nil config gives client with
+// default settings
+func newHttpClient(c *HttpClient) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	client := &http.Client{Transport: transport}
+	if c == nil {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != nil {
+		pem, err := ioutil.ReadFile(*c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + *c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (c.CertFile == nil) != (c.KeyFile == nil) {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+	if c.CertFile != nil {
+		cert, err := tls.LoadX509KeyPair(*c.CertFile, *c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if c.Proxy != nil {
+		if *c.Proxy == "" {
+			transport.Proxy = nil
+		} else {
+			proxyUrl, err := url.Parse(*c.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("malformed proxy URL: %s", err)
+			}
+			transport.Proxy = http.ProxyURL(proxyUrl)
+		}
+	}
+
+	transport.MaxIdleConns = IntOrDefault(c.MaxIdleConns, transport.MaxIdleConns)
+	transport.MaxIdleConnsPerHost = IntOrDefault(c.MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	idleConnTimeout, err := DurationOrDefault(c.IdleConnTimeout, transport.IdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.DisableKeepAlives = c.DisableKeepAlives
+
+	maxRedirects := IntOrDefault(c.MaxRedirects, 10)
+	if maxRedirects < 0 {
+		return nil, errors.New("max_redirects can't be negative")
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+
+	return client, nil
+}
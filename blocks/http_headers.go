@@ -0,0 +1,112 @@
+package blocks
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dbolotin/deadmanswitch/ctyutil"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// validHeaderName checks that the name is a token, as required by RFC 7230
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > '~' || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// staticHeaderNames returns names of the headers given as literal keys of the object
+// expression, so they can be checked before any message arrives
+func staticHeaderNames(expr hcl.Expression) []string {
+	pairs, diag := hcl.ExprMap(expr)
+	if diag.HasErrors() {
+		return nil
+	}
+	var names []string
+	for _, pair := range pairs {
+		key, diag := pair.Key.Value(nil)
+		if diag.HasErrors() || key.IsNull() || !key.IsKnown() || key.Type() != cty.String {
+			continue
+		}
+		names = append(names, key.AsString())
+	}
+	return names
+}
+
+// validateHeaderNames checks names of the headers known at startup
+func validateHeaderNames(expr hcl.Expression) error {
+	for _, name := range staticHeaderNames(expr) {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name \"%s\"", name)
+		}
+	}
+	return nil
+}
+
+// headersFromValue converts map or object of headers to http.Header. Value of a header is
+// either a string or a list of strings, for headers given multiple times; headers with null
+// values are omitted.
+func headersFromValue(value cty.Value) (http.Header, error) {
+	result := make(http.Header)
+	if value.IsNull() {
+		return result, nil
+	}
+	ty := value.Type()
+	if !ty.IsMapType() && !ty.IsObjectType() {
+		return nil, fmt.Errorf("headers must be a map, got %s", ty.FriendlyName())
+	}
+
+	for it := value.ElementIterator(); it.Next(); {
+		k, v := it.Element()
+		name := k.AsString()
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name \"%s\"", name)
+		}
+		if v.IsNull() {
+			continue
+		}
+
+		var values []cty.Value
+		vt := v.Type()
+		if vt.IsListType() || vt.IsTupleType() || vt.IsSetType() {
+			for vit := v.ElementIterator(); vit.Next(); {
+				_, item := vit.Element()
+				values = append(values, item)
+			}
+		} else {
+			values = []cty.Value{v}
+		}
+
+		for _, item := range values {
+			str, err := convert.Convert(item, cty.String)
+			if err != nil || str.IsNull() {
+				return nil, fmt.Errorf("value of header \"%s\" must be a string or a list of strings", name)
+			}
+			s := str.AsString()
+			if strings.ContainsAny(s, "\r\n\x00") {
+				return nil, fmt.Errorf("invalid value of header \"%s\"", name)
+			}
+			result.Add(name, s)
+		}
+	}
+	return result, nil
+}
+
+// headersValue converts headers to a map with lowercased names, multiple values are joined
+// with ", "
+func headersValue(header http.Header) cty.Value {
+	headers := make(map[string]string)
+	for k, v := range header {
+		headers[strings.ToLower(k)] = strings.Join(v, ", ")
+	}
+	return ctyutil.StrMapValue(headers)
+}
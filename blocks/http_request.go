@@ -8,29 +8,37 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dbolotin/deadmanswitch/bctx"
 	"github.com/dbolotin/deadmanswitch/comm"
 	"github.com/dbolotin/deadmanswitch/ctyutil"
 	"github.com/hashicorp/hcl/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/zclconf/go-cty/cty"
-	"github.com/zclconf/go-cty/cty/convert"
-	"github.com/zclconf/go-cty/cty/json"
 )
 
 type HttpRequest struct {
-	SingleChannelBlock
-	Method          string                    `hcl:"method"`
-	URL             hcl.Expression            `hcl:"url"`
-	Timeout         *string                   `hcl:"timeout,optional"`
-	Headers         map[string]hcl.Expression `hcl:"headers,optional"`
-	BasicAuth       *BasicAuth                `hcl:"basic_auth,optional"`
-	Encoding        string                    `hcl:"encoding,optional"`
-	Body            hcl.Expression            `hcl:"body,optional"`
-	DiscardResponse bool                      `hcl:"discard_response,optional"`
+	ProcessingBlock
+	Method          string         `hcl:"method"`
+	URL             hcl.Expression `hcl:"url"`
+	Timeout         *string        `hcl:"timeout,optional"`
+	Headers         hcl.Expression `hcl:"headers,optional"`
+	BasicAuth       *BasicAuth     `hcl:"basic_auth,optional"`
+	Encoding        string         `hcl:"encoding,optional"`
+	Body            hcl.Expression `hcl:"body,optional"`
+	DiscardResponse bool           `hcl:"discard_response,optional"`
+	Client          *HttpClient    `hcl:"client,block"`
+	Retry           *Retry         `hcl:"retry,block"`
+	// Statuses, status classes like "2xx" or ranges like "200-399", treated as success;
+	// "2xx" by default. Other statuses give an error reply, that still has status, headers,
+	// body, duration and attempts of the response.
+	SuccessStatus *[]string `hcl:"success_status,optional"`
+
+	client *http.Client
 }
 
 type BasicAuth struct {
@@ -38,65 +46,82 @@ type BasicAuth struct {
 	Password string `cty:"password"`
 }
 
-// TODO monitoring
+var (
+	httpRequestAttemptsVec         = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_request_attempts"}, []string{"block"})
+	httpRequestRetriesVec          = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_request_retries"}, []string{"block"})
+	httpRequestRetriesExhaustedVec = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_request_retries_exhausted"}, []string{"block"})
+)
+
+func (h *HttpRequest) Validate() []error {
+	var errs []error
+	if _, err := DurationOrDefault(h.Timeout, 15*time.Second); err != nil {
+		errs = append(errs, &AttrError{Attr: "timeout", Err: err})
+	}
+	if _, _, err := NewBodySerializer(h.Encoding); err != nil {
+		errs = append(errs, &AttrError{Attr: "encoding", Err: err})
+	}
+	if err := validateHeaderNames(h.Headers); err != nil {
+		errs = append(errs, &AttrError{Attr: "headers", Err: err})
+	}
+	if _, err := newHttpClient(h.Client); err != nil {
+		errs = append(errs, &AttrError{Attr: "client", Err: err})
+	}
+	if _, err := newRetryPolicy(h.Retry); err != nil {
+		errs = append(errs, &AttrError{Attr: "retry", Err: err})
+	}
+	if _, err := newStatusRanges(h.SuccessStatus); err != nil {
+		errs = append(errs, &AttrError{Attr: "success_status", Err: err})
+	}
+	return errs
+}
 
 func (h *HttpRequest) Start(env *bctx.BEnv) error {
 	// Input channel
 	ch0 := h.Ch0(env)
 
-	timeout, err := time.ParseDuration(StrOrDefault(h.Timeout, "15s"))
+	timeout, err := DurationOrDefault(h.Timeout, 15*time.Second)
 	if err != nil {
 		return err
 	}
 
 	// Creating body serializer
-	var bodySerializer func(value cty.Value) ([]byte, error)
-	var contentType string
-	if h.Encoding == "" || h.Encoding == "json" {
-		contentType = "application/json"
-		bodySerializer = func(value cty.Value) ([]byte, error) {
-			marshal, err := json.Marshal(value, value.Type())
-			return marshal, err
-		}
-	} else if h.Encoding == "urlencoded" || h.Encoding == "url" {
-		contentType = "application/x-www-form-urlencoded"
-		bodySerializer = func(value cty.Value) (res []byte, err error) {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("%s", r)
-				}
-			}()
-
-			if !value.Type().IsObjectType() && !value.Type().IsMapType() {
-				return nil, errors.New("can't decode the value as urlencoded string")
-			}
+	bodySerializer, contentType, err := NewBodySerializer(h.Encoding)
+	if err != nil {
+		return errors.New(err.Error() + " in block \"" + h.Id + "\"")
+	}
 
-			data := url.Values{}
-			for k, v := range value.AsValueMap() {
-				vv, err := convert.Convert(v, cty.String)
-				if err != nil {
-					return nil, err
-				}
-				data.Add(k, vv.AsString())
-			}
-			return []byte(data.Encode()), nil
-		}
-	} else if h.Encoding == "raw" {
-		contentType = "text/plain"
-		bodySerializer = func(value cty.Value) (res []byte, err error) {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("%s", r)
-				}
-			}()
-			return []byte(value.AsString()), nil
-		}
-	} else {
-		return errors.New("unknown content type \"" + h.Encoding + "\" in block \"" + h.Id + "\"")
+	// Each block has its own client, so connection settings of blocks don't interfere
+	client, err := newHttpClient(h.Client)
+	if err != nil {
+		return err
 	}
+	h.client = client
+
+	retry, err := newRetryPolicy(h.Retry)
+	if err != nil {
+		return err
+	}
+
+	successStatus, err := newStatusRanges(h.SuccessStatus)
+	if err != nil {
+		return err
+	}
+
+	// Monitoring
+	pLabels := prometheus.Labels{
+		"block": h.Id,
+	}
+	mAttempts := httpRequestAttemptsVec.With(pLabels)
+	mRetries := httpRequestRetriesVec.With(pLabels)
+	mRetriesExhausted := httpRequestRetriesExhaustedVec.With(pLabels)
+	h.AfterStop(func() {
+		httpRequestAttemptsVec.Delete(pLabels)
+		httpRequestRetriesVec.Delete(pLabels)
+		httpRequestRetriesExhaustedVec.Delete(pLabels)
+	})
 
 	// Spinning up handing goroutine
-	env.StartProcessing(ch0, func(msg comm.Msg) error {
+	env.StartProcessing(&h.Lifecycle, h.Id, ch0, h.Processing, func(msg comm.Msg) error {
 		// Creating the evaluation context
 		evCtx := env.DefaultEvaluationContext(&msg)
 
@@ -107,7 +132,7 @@ func (h *HttpRequest) Start(env *bctx.BEnv) error {
 		}
 		bBody, err := bodySerializer(vBody)
 		if err != nil {
-			return err
+			return comm.NewError(comm.ErrorEvaluation, err)
 		}
 
 		vUrl, err := bctx.EvaluateExpression(h.URL, evCtx)
@@ -116,45 +141,177 @@ func (h *HttpRequest) Start(env *bctx.BEnv) error {
 		}
 		sUrl := vUrl.AsString()
 
-		// Setting up request
-		cCtx := msg.Ctx
-		cCtx, _ = context2.WithTimeout(cCtx, timeout)
-		req, err := http.NewRequestWithContext(cCtx, h.Method, sUrl, bytes.NewBuffer(bBody))
-		if err != nil {
-			return err
+		var headers http.Header
+		if !h.Headers.Range().Empty() {
+			vHeaders, err := bctx.EvaluateExpression(h.Headers, evCtx)
+			if err != nil {
+				return err
+			}
+			headers, err = headersFromValue(vHeaders)
+			if err != nil {
+				return comm.NewError(comm.ErrorEvaluation, err)
+			}
 		}
-		req.Header.Add("Content-Type", contentType)
-		req.Header.Add("Content-Length", strconv.Itoa(len(bBody)))
 
-		if h.BasicAuth != nil {
-			req.SetBasicAuth(h.BasicAuth.User, h.BasicAuth.Password)
+		// Setting up request headers
+		header := make(http.Header)
+		header.Add("Content-Type", contentType)
+		header.Add("Content-Length", strconv.Itoa(len(bBody)))
+
+		// Explicitly set headers override the content type
+		for name, values := range headers {
+			header[name] = values
 		}
 
-		// Executing request
-		resp, err := http.DefaultClient.Do(req)
+		// Executing request, once per attempt
+		attempt := func() (*http.Response, []byte, error) {
+			cCtx, cancel := context2.WithTimeout(msg.Ctx, timeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(cCtx, h.Method, sUrl, bytes.NewReader(bBody))
+			if err != nil {
+				return nil, nil, comm.NewError(comm.ErrorEvaluation, err)
+			}
+			req.Header = header.Clone()
+
+			if h.BasicAuth != nil {
+				req.SetBasicAuth(h.BasicAuth.User, h.BasicAuth.Password)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, nil, transportError(cCtx, err)
+			}
+			defer resp.Body.Close()
+
+			var data []byte
+			if !h.DiscardResponse {
+				data, err = ioutil.ReadAll(resp.Body)
+			} else {
+				_, err = io.Copy(ioutil.Discard, resp.Body)
+			}
+			if err != nil {
+				return nil, nil, transportError(cCtx, err)
+			}
+			return resp, data, nil
+		}
+
+		var resp *http.Response
+		var data []byte
+		var n int
+		started := time.Now()
+		for n = 1; ; n++ {
+			mAttempts.Inc()
+			resp, data, err = attempt()
+			if !retry.retryable(resp, err) || msg.Ctx.Err() != nil {
+				break
+			}
+			if n >= retry.maxAttempts || !sleepContext(msg.Ctx, retry.delay(n, resp)) {
+				mRetriesExhausted.Inc()
+				break
+			}
+			mRetries.Inc()
+		}
+		duration := time.Since(started)
+
 		if err != nil {
+			if cErr, ok := err.(*comm.Error); ok && n > 1 {
+				cErr.Message = fmt.Sprintf("%s (%d attempts)", cErr.Message, n)
+			}
 			return err
 		}
 
 		// Handing response body
-		var responseBody cty.Value
+		responseBody := ctyutil.StrNullVal
 		if !h.DiscardResponse {
-			responseBody, err = BodyToValue(resp.Body, resp.Header)
+			responseBody, err = BytesToValue(data, resp.Header)
 			if err != nil {
-				return err
+				return comm.NewError(comm.ErrorTransport, err)
 			}
-		} else {
-			_, err := io.Copy(ioutil.Discard, resp.Body)
-			if err != nil {
-				return err
+		}
+
+		reply := map[string]cty.Value{
+			"body":    responseBody,
+			"status":  cty.NumberIntVal(int64(resp.StatusCode)),
+			"headers": headersValue(resp.Header),
+			// Time spent on all attempts, in seconds
+			"duration": cty.NumberFloatVal(duration.Seconds()),
+			"attempts": cty.NumberIntVal(int64(n)),
+		}
+
+		// Unexpected status is an error reply that still describes the response, so error
+		// handlers can branch on the status and read the body
+		if !successStatus.contains(resp.StatusCode) {
+			sErr := comm.Errorf(comm.ErrorUpstreamStatus, "unexpected response status %d", resp.StatusCode)
+			if n > 1 {
+				sErr.Message = fmt.Sprintf("%s (%d attempts)", sErr.Message, n)
 			}
-			responseBody = ctyutil.StrNullVal
+			sErr.Block = h.Id
+			env.WriteError(sErr)
+			reply["err"] = sErr.Value()
 		}
 
-		// Success
-		msg.Reply(cty.ObjectVal(map[string]cty.Value{"body": responseBody}))
+		msg.Reply(cty.ObjectVal(reply))
 		return nil
 	})
 
 	return nil
 }
+
+func (h *HttpRequest) Stop(ctx context2.Context) error {
+	err := h.Lifecycle.Stop(ctx)
+	if h.client != nil {
+		h.client.CloseIdleConnections()
+	}
+	return err
+}
+
+// Set of HTTP statuses, given as ranges
+type statusRanges [][2]int
+
+// newStatusRanges parses statuses like "200", classes like "2xx" and ranges like "200-299";
+// nil list gives "2xx"
+func newStatusRanges(specs *[]string) (statusRanges, error) {
+	if specs == nil {
+		return statusRanges{{200, 299}}, nil
+	}
+
+	var result statusRanges
+	for _, spec := range *specs {
+		var from, to int
+		var err error
+		if len(spec) == 3 && strings.HasSuffix(spec, "xx") {
+			from, err = strconv.Atoi(spec[:1])
+			from, to = from*100, from*100+99
+		} else if bounds := strings.SplitN(spec, "-", 2); len(bounds) == 2 {
+			from, err = strconv.Atoi(strings.TrimSpace(bounds[0]))
+			if err == nil {
+				to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			}
+		} else {
+			from, err = strconv.Atoi(spec)
+			to = from
+		}
+		if err != nil || from < 100 || to > 999 || from > to {
+			return nil, fmt.Errorf("invalid status \"%s\"", spec)
+		}
+		result = append(result, [2]int{from, to})
+	}
+	return result, nil
+}
+
+func (r statusRanges) contains(status int) bool {
+	for _, rng := range r {
+		if status >= rng[0] && status <= rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Failure to communicate with the remote service, caused by the request timeout if its context expired
+func transportError(ctx context2.Context, err error) *comm.Error {
+	if ctx.Err() == context2.DeadlineExceeded {
+		return comm.NewError(comm.ErrorTimeout, err)
+	}
+	return comm.NewError(comm.ErrorTransport, err)
+}
@@ -0,0 +1,108 @@
+package blocks
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dbolotin/deadmanswitch/ctyutil"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Message attribute describing the incoming HTTP request
+type requestAttribute func(r *http.Request) cty.Value
+
+// Message attributes describing the incoming HTTP request, by name; headers are configured
+// separately
+var requestAttributes = map[string]requestAttribute{
+	// First value of each query parameter
+	"query": func(r *http.Request) cty.Value {
+		query := make(map[string]string)
+		for k, v := range r.URL.Query() {
+			query[k] = v[0]
+		}
+		return ctyutil.StrMapValue(query)
+	},
+	"method": func(r *http.Request) cty.Value {
+		return cty.StringVal(r.Method)
+	},
+	// Client IP address, without port
+	"remote_addr": func(r *http.Request) cty.Value {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return cty.StringVal(r.RemoteAddr)
+		}
+		return cty.StringVal(host)
+	},
+	"host": func(r *http.Request) cty.Value {
+		return cty.StringVal(r.Host)
+	},
+	"path": func(r *http.Request) cty.Value {
+		return cty.StringVal(r.URL.Path)
+	},
+	// Verified client certificate: subject, common_name, issuer and serial; null without mutual TLS
+	"client_cert": clientCertValue,
+}
+
+// Attribute with request headers: "headers" selects all headers except the credentials, while
+// "headers.<name>" selects a single header, credentials included
+const headersAttribute = "headers"
+
+// Headers carrying credentials, left out of the headers attribute unless requested by name
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+}
+
+// requestAttributeSet resolves the request attributes added to messages of the endpoint, by
+// name; none are added by default
+func requestAttributeSet(names *[]string) (map[string]requestAttribute, error) {
+	result := make(map[string]requestAttribute)
+	if names == nil {
+		return result, nil
+	}
+
+	allHeaders := false
+	var selectedHeaders []string
+	for _, name := range *names {
+		if name == headersAttribute {
+			allHeaders = true
+			continue
+		}
+		if header := strings.TrimPrefix(name, headersAttribute+"."); header != name {
+			if !validHeaderName(header) {
+				return nil, fmt.Errorf("invalid header name in request attribute \"%s\"", name)
+			}
+			selectedHeaders = append(selectedHeaders, http.CanonicalHeaderKey(header))
+			continue
+		}
+		attr, ok := requestAttributes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown request attribute \"%s\"", name)
+		}
+		result[name] = attr
+	}
+
+	if allHeaders || len(selectedHeaders) != 0 {
+		result[headersAttribute] = func(r *http.Request) cty.Value {
+			header := make(http.Header)
+			if allHeaders {
+				for name, values := range r.Header {
+					if !sensitiveHeaders[name] {
+						header[name] = values
+					}
+				}
+			}
+			for _, name := range selectedHeaders {
+				if values, ok := r.Header[name]; ok {
+					header[name] = values
+				}
+			}
+			// Header names are lowercased, multiple values are joined with ", "
+			return headersValue(header)
+		}
+	}
+	return result, nil
+}
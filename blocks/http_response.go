@@ -0,0 +1,100 @@
+package blocks
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dbolotin/deadmanswitch/bctx"
+	"github.com/dbolotin/deadmanswitch/comm"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/gocty"
+)
+
+// Response defines HTTP response of the endpoint, built from the message ("msg") and the reply
+// of the downstream block ("reply")
+type Response struct {
+	Status   hcl.Expression `hcl:"status,optional"`
+	Headers  hcl.Expression `hcl:"headers,optional"`
+	Body     hcl.Expression `hcl:"body,optional"`
+	Encoding string         `hcl:"encoding,optional"`
+}
+
+// writeResponse evaluates the response definition and writes the result. Reply is null if
+// the downstream block didn't reply. Nothing is written if evaluation fails.
+func (r *Response) writeResponse(w http.ResponseWriter, env *bctx.BEnv, msg *comm.Msg, reply cty.Value, hasReply bool) error {
+	serializer, contentType, err := NewBodySerializer(r.Encoding)
+	if err != nil {
+		return err
+	}
+
+	evCtx := env.DefaultEvaluationContext(msg)
+	if !hasReply {
+		reply = cty.NullVal(cty.DynamicPseudoType)
+	}
+	evCtx.Variables["reply"] = reply
+
+	status := http.StatusOK
+	if !r.Status.Range().Empty() {
+		value, err := bctx.EvaluateExpression(r.Status, evCtx)
+		if err != nil {
+			return err
+		}
+		if value.IsNull() {
+			return errors.New("response status is null")
+		}
+		value, err = convert.Convert(value, cty.Number)
+		if err != nil {
+			return fmt.Errorf("wrong response status: %s", err)
+		}
+		if err := gocty.FromCtyValue(value, &status); err != nil {
+			return fmt.Errorf("wrong response status: %s", err)
+		}
+		if status < 100 || status > 999 {
+			return errors.New("wrong response status: " + strconv.Itoa(status))
+		}
+	}
+
+	var body []byte
+	if !r.Body.Range().Empty() {
+		value, err := bctx.EvaluateExpression(r.Body, evCtx)
+		if err != nil {
+			return err
+		}
+		if !value.IsNull() {
+			body, err = serializer(value)
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+
+	// Explicitly set headers override the content type
+	if !r.Headers.Range().Empty() {
+		value, err := bctx.EvaluateExpression(r.Headers, evCtx)
+		if err != nil {
+			return err
+		}
+		var headers map[string]string
+		if !value.IsNull() {
+			value, err = convert.Convert(value, cty.Map(cty.String))
+			if err == nil {
+				err = gocty.FromCtyValue(value, &headers)
+			}
+			if err != nil {
+				return fmt.Errorf("wrong response headers: %s", err)
+			}
+		}
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+	}
+
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	return nil
+}
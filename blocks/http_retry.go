@@ -0,0 +1,177 @@
+package blocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dbolotin/deadmanswitch/comm"
+)
+
+// Retry makes http_request repeat the request on transient failures
+type Retry struct {
+	// Total number of attempts, including the first one; 3 by default
+	MaxAttempts *int `hcl:"max_attempts,optional"`
+	// Delay before the first retry, 1s by default; doubled for each subsequent retry
+	InitialBackoff *string `hcl:"initial_backoff,optional"`
+	// Upper limit of the delay, also applied to the one given in Retry-After; 30s by default
+	MaxBackoff *string `hcl:"max_backoff,optional"`
+	// Fraction of the delay it's randomly changed by, 0.2 by default
+	Jitter *float64 `hcl:"jitter,optional"`
+	// Response statuses and failures to retry on: "network" for connection failures and
+	// "timeout" for requests exceeded their timeout; 429, 502, 503, 504, "network" and
+	// "timeout" by default
+	RetryOn *[]string `hcl:"retry_on,optional"`
+}
+
+var defaultRetryOn = []string{"429", "502", "503", "504", "network", "timeout"}
+
+// retryPolicy is the parsed retry configuration
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	statuses       map[int]bool
+	kinds          map[comm.ErrorKind]bool
+}
+
+// newRetryPolicy parses the configuration; nil configuration gives policy with a single attempt
+func newRetryPolicy(r *Retry) (*retryPolicy, error) {
+	if r == nil {
+		return &retryPolicy{maxAttempts: 1}, nil
+	}
+
+	p := &retryPolicy{
+		maxAttempts: IntOrDefault(r.MaxAttempts, 3),
+		jitter:      0.2,
+		statuses:    make(map[int]bool),
+		kinds:       make(map[comm.ErrorKind]bool),
+	}
+	if p.maxAttempts < 1 {
+		return nil, errors.New("max_attempts must be positive")
+	}
+
+	var err error
+	if p.initialBackoff, err = DurationOrDefault(r.InitialBackoff, time.Second); err != nil {
+		return nil, err
+	}
+	if p.maxBackoff, err = DurationOrDefault(r.MaxBackoff, 30*time.Second); err != nil {
+		return nil, err
+	}
+	if p.initialBackoff < 0 || p.maxBackoff < p.initialBackoff {
+		return nil, errors.New("backoff must be non-negative, with max_backoff not less than initial_backoff")
+	}
+
+	if r.Jitter != nil {
+		p.jitter = *r.Jitter
+	}
+	if p.jitter < 0 || p.jitter > 1 {
+		return nil, errors.New("jitter must be between 0 and 1")
+	}
+
+	retryOn := defaultRetryOn
+	if r.RetryOn != nil {
+		retryOn = *r.RetryOn
+	}
+	for _, cond := range retryOn {
+		switch cond {
+		case "network":
+			p.kinds[comm.ErrorTransport] = true
+		case "timeout":
+			p.kinds[comm.ErrorTimeout] = true
+		default:
+			status, err := strconv.Atoi(cond)
+			if err != nil || status < 100 || status > 999 {
+				return nil, fmt.Errorf("unknown retry_on condition \"%s\"", cond)
+			}
+			p.statuses[status] = true
+		}
+	}
+
+	return p, nil
+}
+
+// retryable tells whether the attempt, that either got a response or failed with the error,
+// is worth repeating
+func (p *retryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var cErr *comm.Error
+		return errors.As(err, &cErr) && p.kinds[cErr.Kind]
+	}
+	return resp != nil && p.statuses[resp.StatusCode]
+}
+
+// delay returns time to wait after the given failed attempt, counted from 1
+func (p *retryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header, time.Now()); ok {
+			if d > p.maxBackoff {
+				return p.maxBackoff
+			}
+			return d
+		}
+	}
+
+	d := p.initialBackoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return time.Duration(float64(d) * (1 + p.jitter*(2*randomFloat()-1)))
+}
+
+// retryAfter parses Retry-After header, given either in seconds or as HTTP date
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sleepContext waits for the given time; returns false if the context ended earlier, or
+// is going to end before that
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+var (
+	jitterRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterRandLock sync.Mutex
+)
+
+func randomFloat() float64 {
+	jitterRandLock.Lock()
+	defer jitterRandLock.Unlock()
+	return jitterRand.Float64()
+}
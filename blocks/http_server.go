@@ -1,12 +1,16 @@
 package blocks
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -22,13 +26,19 @@ import (
 	"github.com/zclconf/go-cty/cty"
 )
 
+// Interval of attempts to bind the address taken by another server
+const listenRetryInterval = time.Second
+
 type HttpServer struct {
-	SingleChannelBlock
+	IsolatedBlock
 	Address string  `hcl:"address"`
 	Timeout *string `hcl:"timeout,optional"`
 
 	Endpoints  []Endpoint          `hcl:"endpoint,block"`
 	Monitoring *MonitoringEndpoint `hcl:"monitoring_endpoint,block"`
+	TLS        *TLS                `hcl:"tls,block"`
+
+	srv *http.Server
 }
 
 type Endpoint struct {
@@ -38,8 +48,18 @@ type Endpoint struct {
 	DiscardBody    bool      `hcl:"discard_body,optional"`
 	ParseListAsMap bool      `hcl:"parse_list_as_map,optional"`
 	MaxBodySize    *int64    `hcl:"max_body_size,optional"`
+	// Request attributes added to the message: headers, query, method, remote_addr, host, path,
+	// client_cert; none by default. Headers carrying credentials (authorization, cookie and
+	// proxy-authorization) are only added if requested by name, e.g. "headers.authorization".
+	RequestAttributes *[]string `hcl:"request_attributes,optional"`
+	// Whether error replies include messages, block ids and causes of the errors; otherwise
+	// only the kind of the error and a generic message are returned to the client
+	ErrorDetails bool `hcl:"error_details,optional"`
 
-	SendTo bctx.ChannelPointer `hcl:"send_to"`
+	SendTo   bctx.ChannelPointer `hcl:"send_to"`
+	Auth     *Auth               `hcl:"auth,block"`
+	Verify   *Verify             `hcl:"verify,block"`
+	Response *Response           `hcl:"response,block"`
 }
 
 type MonitoringEndpoint struct {
@@ -47,26 +67,58 @@ type MonitoringEndpoint struct {
 }
 
 var (
-	hsHitsVec             = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_hits"}, []string{"block", "endpoint", "path"})
-	hsDecodingErrorsVec   = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_decoding_errors"}, []string{"block", "endpoint", "path"})
-	hsDownstreamErrorsVec = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_downstream_errors"}, []string{"block", "endpoint", "path"})
-	hsTotalErrorsVec      = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_total_errors"}, []string{"block", "endpoint", "path"})
+	hsHitsVec                 = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_hits"}, []string{"block", "endpoint", "path"})
+	hsDecodingErrorsVec       = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_decoding_errors"}, []string{"block", "endpoint", "path"})
+	hsDownstreamErrorsVec     = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_downstream_errors"}, []string{"block", "endpoint", "path"})
+	hsTotalErrorsVec          = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_total_errors"}, []string{"block", "endpoint", "path"})
+	hsAuthFailuresVec         = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_auth_failures"}, []string{"block", "endpoint", "path"})
+	hsVerificationFailuresVec = promauto.NewCounterVec(prometheus.CounterOpts{Name: "http_server_verification_failures"}, []string{"block", "endpoint", "path"})
 )
 
+func (h *HttpServer) Validate() []error {
+	var errs []error
+	if _, err := DurationOrDefault(h.Timeout, 0*time.Second); err != nil {
+		errs = append(errs, &AttrError{Attr: "timeout", Err: err})
+	}
+	if h.TLS != nil {
+		if _, err := h.TLS.newConfig(); err != nil {
+			errs = append(errs, &AttrError{Attr: "tls", Err: err})
+		}
+	}
+	for _, ep := range h.Endpoints {
+		if _, err := requestAttributeSet(ep.RequestAttributes); err != nil {
+			errs = append(errs, &AttrError{Attr: "endpoint.request_attributes", Err: err})
+		}
+		if ep.Auth != nil {
+			if _, _, err := ep.Auth.newAuthenticator(); err != nil {
+				errs = append(errs, &AttrError{Attr: "endpoint.auth", Err: err})
+			}
+		}
+		if ep.Verify != nil {
+			if _, err := ep.Verify.newVerifier(); err != nil {
+				errs = append(errs, &AttrError{Attr: "endpoint.verify", Err: err})
+			}
+		}
+		if ep.Response == nil {
+			continue
+		}
+		if _, _, err := NewBodySerializer(ep.Response.Encoding); err != nil {
+			errs = append(errs, &AttrError{Attr: "endpoint.response.encoding", Err: err})
+		}
+	}
+	return errs
+}
+
 func (h *HttpServer) Start(env *bctx.BEnv) error {
 	router := mux.NewRouter()
 
-	timeout := 0 * time.Second
+	timeout, err := DurationOrDefault(h.Timeout, 0*time.Second)
+	if err != nil {
+		return err
+	}
 	rwTimeout := 15 * time.Second
-	if h.Timeout != nil {
-		var err error
-		timeout, err = time.ParseDuration(*h.Timeout)
-		if err != nil {
-			return err
-		}
-		if rwTimeout > timeout {
-			rwTimeout = timeout
-		}
+	if h.Timeout != nil && rwTimeout > timeout {
+		rwTimeout = timeout
 	}
 
 	if h.Monitoring != nil {
@@ -75,6 +127,9 @@ func (h *HttpServer) Start(env *bctx.BEnv) error {
 
 	// Instantiating endpoints
 	for i, ep := range h.Endpoints {
+		// Captured by the handler
+		ep := ep
+
 		// Monitoring counters
 		pLabels := prometheus.Labels{
 			"block":    h.Id,
@@ -85,10 +140,34 @@ func (h *HttpServer) Start(env *bctx.BEnv) error {
 		mDecodingErrors := hsDecodingErrorsVec.With(pLabels)
 		mTotalErrors := hsTotalErrorsVec.With(pLabels)
 		mDownstreamErrors := hsDownstreamErrorsVec.With(pLabels)
+		mAuthFailures := hsAuthFailuresVec.With(pLabels)
+		mVerificationFailures := hsVerificationFailuresVec.With(pLabels)
 
 		// Resolving target communication channel
 		sendTo := ep.SendTo.SendCh(env)
 
+		attrs, err := requestAttributeSet(ep.RequestAttributes)
+		if err != nil {
+			return err
+		}
+
+		var authenticate authenticator
+		var challenge string
+		if ep.Auth != nil {
+			authenticate, challenge, err = ep.Auth.newAuthenticator()
+			if err != nil {
+				return err
+			}
+		}
+
+		var verify verifier
+		if ep.Verify != nil {
+			verify, err = ep.Verify.newVerifier()
+			if err != nil {
+				return err
+			}
+		}
+
 		// Building route
 		route := router.Path(ep.Path)
 		if ep.Methods != nil {
@@ -104,17 +183,60 @@ func (h *HttpServer) Start(env *bctx.BEnv) error {
 				valMap["url"] = ctyutil.StrMapValue(vars)
 			}
 
+			// Checking credentials
+			if authenticate != nil && !authenticate(r) {
+				mAuthFailures.Inc()
+				mTotalErrors.Inc()
+				log.Println("Authentication failed on", ep.Path, "for", r.RemoteAddr)
+				if challenge != "" {
+					w.Header().Set("WWW-Authenticate", challenge)
+				}
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			// Request attributes
+			for name, attr := range attrs {
+				valMap[name] = attr(r)
+			}
+
 			// Request context; will be passed along with the message
 			ctx := r.Context()
 
 			// Limiting body size
 			r.Body = http.MaxBytesReader(w, r.Body, Int64OrDefault(ep.MaxBodySize, 1048576))
 
+			// Reading raw request body
+			var raw []byte
+			if !ep.DiscardBody || verify != nil {
+				var err error
+				raw, err = ioutil.ReadAll(r.Body)
+				if err != nil {
+					mDecodingErrors.Inc()
+					mTotalErrors.Inc()
+					log.Println(err)
+					http.Error(w, "error reading request body", http.StatusBadRequest)
+					return
+				}
+			}
+
+			// Checking signature
+			if verify != nil {
+				err := verify(r.Header, raw, time.Now())
+				if err != nil {
+					mVerificationFailures.Inc()
+					mTotalErrors.Inc()
+					log.Println("Webhook verification failed on", ep.Path, ":", err)
+					http.Error(w, "invalid signature", http.StatusUnauthorized)
+					return
+				}
+			}
+
 			// Parsing request body
 			body := ctyutil.StrNullVal
 			if !ep.DiscardBody {
 				var err error
-				body, err = BodyToValue(r.Body, r.Header)
+				body, err = BytesToValue(raw, r.Header)
 				if err != nil {
 					mDecodingErrors.Inc()
 					mTotalErrors.Inc()
@@ -143,11 +265,18 @@ func (h *HttpServer) Start(env *bctx.BEnv) error {
 			case <-r.Context().Done():
 				mTotalErrors.Inc()
 				log.Println("Client disconnected before receiving reply.")
-			case rep := <-ch:
-				if comm.IsErrorReply(rep) {
+			case rep, hasReply := <-ch:
+				if repErr := comm.ErrorFromReply(rep); repErr != nil {
 					mDownstreamErrors.Inc()
 					mTotalErrors.Inc()
-					http.Error(w, "error processing request", http.StatusBadRequest)
+					writeError(w, r, repErr, ep.ErrorDetails)
+				} else if ep.Response != nil {
+					err := ep.Response.writeResponse(w, env, &msg, rep, hasReply)
+					if err != nil {
+						mTotalErrors.Inc()
+						env.WriteError(err)
+						writeError(w, r, comm.AsError(h.Id, comm.NewError(comm.ErrorEvaluation, err)), ep.ErrorDetails)
+					}
 				}
 			}
 
@@ -156,7 +285,7 @@ func (h *HttpServer) Start(env *bctx.BEnv) error {
 	}
 
 	// Creating http server
-	srv := &http.Server{
+	h.srv = &http.Server{
 		Handler: router,
 		Addr:    h.Address,
 
@@ -164,20 +293,154 @@ func (h *HttpServer) Start(env *bctx.BEnv) error {
 		ReadTimeout:  rwTimeout,
 	}
 
-	log.Println("Listening for incoming HTTP connections on ", h.Address)
+	if h.TLS != nil {
+		h.srv.TLSConfig, err = h.TLS.newConfig()
+		if err != nil {
+			return err
+		}
+		log.Println("Listening for incoming HTTPS connections on ", h.Address)
+	} else {
+		log.Println("Listening for incoming HTTP connections on ", h.Address)
+	}
 
 	// Staring server in a separate go routine
+	srv := h.srv
 	go func() {
-		log.Fatal(srv.ListenAndServe())
+		listener := h.listen(env)
+		if listener == nil {
+			return
+		}
+
+		var err error
+		if srv.TLSConfig != nil {
+			// Certificate is provided by the TLS config
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			env.WriteError(fmt.Errorf("HTTP server on %s failed: %s", h.Address, err))
+		}
 	}()
 
 	// Initialized without errors
 	return nil
 }
 
+// listen binds the address of the server. Address may still be taken by the server this one
+// replaces on reload, so binding is retried until it succeeds or the block is stopped; nil
+// is returned in the latter case.
+func (h *HttpServer) listen(env *bctx.BEnv) net.Listener {
+	address := h.Address
+	if address == "" {
+		address = ":http"
+		if h.srv.TLSConfig != nil {
+			address = ":https"
+		}
+	}
+
+	for failed := false; ; failed = true {
+		listener, err := net.Listen("tcp", address)
+		if err == nil {
+			if failed {
+				log.Println("Address is free now, listening on ", h.Address)
+			}
+			return listener
+		}
+		if !failed {
+			env.WriteError(fmt.Errorf("can't listen on %s, retrying every %s: %s", h.Address, listenRetryInterval, err))
+		}
+
+		select {
+		case <-h.Done():
+			return nil
+		case <-time.After(listenRetryInterval):
+		}
+	}
+}
+
+func (h *HttpServer) Stop(ctx context.Context) error {
+	err := h.Lifecycle.Stop(ctx)
+
+	if h.srv == nil {
+		return err
+	}
+
+	log.Println("Closing HTTP server on ", h.Address)
+
+	// Releases the address, so a replacement server can start listening on it; requests still
+	// in flight are cut off if they didn't complete in time
+	if err != nil {
+		h.srv.Close()
+		return err
+	}
+	return h.srv.Shutdown(ctx)
+}
+
+// HTTP statuses of replies to requests failed downstream, by error kind
+var errorStatuses = map[comm.ErrorKind]int{
+	comm.ErrorEvaluation:     http.StatusInternalServerError,
+	comm.ErrorTransport:      http.StatusBadGateway,
+	comm.ErrorTimeout:        http.StatusGatewayTimeout,
+	comm.ErrorUpstreamStatus: http.StatusBadGateway,
+	comm.ErrorRejected:       http.StatusServiceUnavailable,
+	comm.ErrorInternal:       http.StatusInternalServerError,
+}
+
+// Messages returned to the client instead of the error details
+var errorMessages = map[comm.ErrorKind]string{
+	comm.ErrorEvaluation:     "error processing request",
+	comm.ErrorTransport:      "upstream service unavailable",
+	comm.ErrorTimeout:        "processing timed out",
+	comm.ErrorUpstreamStatus: "upstream service failed",
+	comm.ErrorRejected:       "request rejected, try again later",
+	comm.ErrorInternal:       "internal error",
+}
+
+// Writes the error as JSON object: {"error": {"kind": ..., "message": ...}}. Details of the error
+// are logged, and are only returned to the client if requested: {"error": {"kind": ...,
+// "message": ..., "block": ..., "causes": [...]}}
+func writeError(w http.ResponseWriter, r *http.Request, e *comm.Error, details bool) {
+	status, ok := errorStatuses[e.Kind]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	log.Printf("Error processing request to %s: %s", r.URL.Path, e)
+
+	reply := e
+	if !details {
+		message, ok := errorMessages[e.Kind]
+		if !ok {
+			message = errorMessages[comm.ErrorInternal]
+		}
+		reply = &comm.Error{Kind: e.Kind, Message: message}
+	}
+
+	body, err := json.Marshal(map[string]*comm.Error{"error": reply})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "error processing request", status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
 func BodyToValue(body io.ReadCloser, header http.Header) (cty.Value, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.Println(err)
+		return cty.Value{}, errors.New("error reading request body")
+	}
+	return BytesToValue(data, header)
+}
+
+// BytesToValue decodes raw body of a request or response according to its content type
+func BytesToValue(data []byte, header http.Header) (cty.Value, error) {
 	if HasContentType(header, "application/json") {
-		dec := json.NewDecoder(body)
+		dec := json.NewDecoder(bytes.NewReader(data))
 		var v interface{}
 		err := dec.Decode(&v)
 		if err != nil {
@@ -194,12 +457,7 @@ func BodyToValue(body io.ReadCloser, header http.Header) (cty.Value, error) {
 		}
 		return body, nil
 	} else if HasContentType(header, "application/x-www-form-urlencoded") {
-		bytes, err := ioutil.ReadAll(body)
-		if err != nil {
-			log.Println(err)
-			return cty.Value{}, errors.New("error parsing request")
-		}
-		query, err := url.ParseQuery(string(bytes))
+		query, err := url.ParseQuery(string(data))
 		if err != nil {
 			log.Println(err)
 			return cty.Value{}, errors.New("error parsing request")
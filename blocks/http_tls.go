@@ -0,0 +1,165 @@
+package blocks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// TLS enables HTTPS for the server, optionally verifying client certificates
+type TLS struct {
+	CertFile string `hcl:"cert_file"`
+	KeyFile  string `hcl:"key_file"`
+	// CA bundle to verify client certificates with; client certificates are not requested if unset
+	ClientCAFile *string `hcl:"client_ca_file,optional"`
+	// Whether client certificate is "required" (default) or "optional"
+	ClientAuth *string `hcl:"client_auth,optional"`
+	// "1.0", "1.1", "1.2" (default) or "1.3"
+	MinVersion *string `hcl:"min_version,optional"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// How often certificate files are checked for changes
+const certificateCheckInterval = 10 * time.Second
+
+// certificateLoader keeps the certificate loaded from files, re-reading them when they change
+type certificateLoader struct {
+	certFile, keyFile string
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	// Time of the last check of the files
+	checked time.Time
+}
+
+func fileModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// load reads the certificate if its files changed since the last load
+func (c *certificateLoader) load() error {
+	certTime, err := fileModTime(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyTime, err := fileModTime(c.keyFile)
+	if err != nil {
+		return err
+	}
+	modTimes := [2]time.Time{certTime, keyTime}
+	if c.cert != nil && modTimes == c.modTimes {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.Println("TLS certificate reloaded from", c.certFile)
+	}
+	c.cert = &cert
+	c.modTimes = modTimes
+	return nil
+}
+
+// getCertificate serves the certificate, keeping the previous one if the files can't be read;
+// files are checked for changes at most once per check interval, not on every handshake
+func (c *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.checked) < certificateCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = now
+	if err := c.load(); err != nil {
+		log.Println("Error reloading TLS certificate:", err)
+	}
+	return c.cert, nil
+}
+
+// newConfig creates server TLS configuration
+func (t *TLS) newConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[StrOrDefault(t.MinVersion, "1.2")]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version \"%s\"", *t.MinVersion)
+	}
+
+	loader := &certificateLoader{certFile: t.CertFile, keyFile: t.KeyFile, checked: time.Now()}
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: loader.getCertificate,
+	}
+
+	if t.ClientCAFile != nil {
+		pem, err := ioutil.ReadFile(*t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + *t.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+
+		switch StrOrDefault(t.ClientAuth, "required") {
+		case "required":
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown client_auth \"%s\"", *t.ClientAuth)
+		}
+	} else if t.ClientAuth != nil {
+		return nil, errors.New("client_auth requires client_ca_file")
+	}
+
+	return cfg, nil
+}
+
+var clientCertType = cty.Object(map[string]cty.Type{
+	"subject":     cty.String,
+	"common_name": cty.String,
+	"issuer":      cty.String,
+	"serial":      cty.String,
+})
+
+// clientCertValue describes verified client certificate of the request, null if there is none
+func clientCertValue(r *http.Request) cty.Value {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return cty.NullVal(clientCertType)
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	return cty.ObjectVal(map[string]cty.Value{
+		"subject":     cty.StringVal(cert.Subject.String()),
+		"common_name": cty.StringVal(cert.Subject.CommonName),
+		"issuer":      cty.StringVal(cert.Issuer.String()),
+		"serial":      cty.StringVal(cert.SerialNumber.String()),
+	})
+}
@@ -0,0 +1,194 @@
+package blocks
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verify defines check of the webhook signature, computed by the sender as HMAC of the
+// raw request body
+type Verify struct {
+	// Signature scheme: "hmac" (default), "github", "stripe" or "slack"
+	Style  string `hcl:"style,optional"`
+	Secret string `hcl:"secret"`
+
+	// Settings of the "hmac" style; "github" style only allows to change the algorithm
+	Algorithm *string `hcl:"algorithm,optional"`
+	Header    *string `hcl:"header,optional"`
+	Prefix    *string `hcl:"prefix,optional"`
+	Encoding  *string `hcl:"encoding,optional"`
+
+	// Max age of the signed timestamp for "stripe" and "slack" styles; zero disables the check
+	Tolerance *string `hcl:"tolerance,optional"`
+}
+
+// Checks signature of the request with the given raw body
+type verifier func(header http.Header, body []byte, now time.Time) error
+
+var errSignatureMismatch = errors.New("signature mismatch")
+
+func hashByName(name string) (func() hash.Hash, error) {
+	switch name {
+	case "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm \"%s\"", name)
+	}
+}
+
+func signature(h func() hash.Hash, secret string, parts ...[]byte) []byte {
+	mac := hmac.New(h, []byte(secret))
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+// Checks that the timestamp, in seconds since epoch, is within the tolerance
+func checkTimestamp(timestamp string, tolerance time.Duration, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	if tolerance == 0 {
+		return nil
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp is outside of the tolerance")
+	}
+	return nil
+}
+
+// newVerifier creates verifier for the style of the configuration
+func (v *Verify) newVerifier() (verifier, error) {
+	// Empty secret, e.g. taken from an unset environment variable, would make signatures trivial
+	// to forge
+	if v.Secret == "" {
+		return nil, errors.New("secret must not be empty")
+	}
+
+	tolerance, err := DurationOrDefault(v.Tolerance, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v.Style {
+	case "", "hmac", "github":
+		algorithm := StrOrDefault(v.Algorithm, "sha256")
+		h, err := hashByName(algorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		header, prefix, encoding := "", "", "hex"
+		if v.Style == "github" {
+			header, prefix = "X-Hub-Signature-256", "sha256="
+			if algorithm == "sha1" {
+				header, prefix = "X-Hub-Signature", "sha1="
+			}
+		}
+		header = StrOrDefault(v.Header, header)
+		prefix = StrOrDefault(v.Prefix, prefix)
+		encoding = StrOrDefault(v.Encoding, encoding)
+		if header == "" {
+			return nil, errors.New("signature header is not set")
+		}
+
+		var decode func(string) ([]byte, error)
+		switch encoding {
+		case "hex":
+			decode = hex.DecodeString
+		case "base64":
+			decode = base64.StdEncoding.DecodeString
+		default:
+			return nil, fmt.Errorf("unknown signature encoding \"%s\"", encoding)
+		}
+
+		return func(hd http.Header, body []byte, _ time.Time) error {
+			value := hd.Get(header)
+			if value == "" || !strings.HasPrefix(value, prefix) {
+				return errors.New("missing signature")
+			}
+			given, err := decode(strings.TrimPrefix(value, prefix))
+			if err != nil {
+				return errors.New("malformed signature")
+			}
+			if !hmac.Equal(given, signature(h, v.Secret, body)) {
+				return errSignatureMismatch
+			}
+			return nil
+		}, nil
+
+	case "stripe":
+		// Stripe-Signature: t=<timestamp>,v1=<signature>[,v1=<signature>...]
+		return func(hd http.Header, body []byte, now time.Time) error {
+			var timestamp string
+			var signatures [][]byte
+			for _, item := range strings.Split(hd.Get("Stripe-Signature"), ",") {
+				kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				switch kv[0] {
+				case "t":
+					timestamp = kv[1]
+				case "v1":
+					if sig, err := hex.DecodeString(kv[1]); err == nil {
+						signatures = append(signatures, sig)
+					}
+				}
+			}
+			if timestamp == "" || len(signatures) == 0 {
+				return errors.New("missing signature")
+			}
+			if err := checkTimestamp(timestamp, tolerance, now); err != nil {
+				return err
+			}
+			expected := signature(sha256.New, v.Secret, []byte(timestamp), []byte("."), body)
+			for _, sig := range signatures {
+				if hmac.Equal(sig, expected) {
+					return nil
+				}
+			}
+			return errSignatureMismatch
+		}, nil
+
+	case "slack":
+		// X-Slack-Signature: v0=<signature of "v0:<timestamp>:<body>">
+		return func(hd http.Header, body []byte, now time.Time) error {
+			timestamp := hd.Get("X-Slack-Request-Timestamp")
+			value := hd.Get("X-Slack-Signature")
+			if timestamp == "" || !strings.HasPrefix(value, "v0=") {
+				return errors.New("missing signature")
+			}
+			if err := checkTimestamp(timestamp, tolerance, now); err != nil {
+				return err
+			}
+			given, err := hex.DecodeString(strings.TrimPrefix(value, "v0="))
+			if err != nil {
+				return errors.New("malformed signature")
+			}
+			expected := signature(sha256.New, v.Secret, []byte("v0:"+timestamp+":"), body)
+			if !hmac.Equal(given, expected) {
+				return errSignatureMismatch
+			}
+			return nil
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown verification style \"%s\"", v.Style)
+	}
+}
@@ -0,0 +1,64 @@
+package blocks
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/dbolotin/deadmanswitch/bctx"
+)
+
+// Link is a reference from an attribute of a block to the input channel of another block
+type Link struct {
+	// Path to the attribute, e.g. "endpoint.send_to"
+	Attr   string
+	Target string
+}
+
+var channelPointerType = reflect.TypeOf(bctx.ChannelPointer{})
+
+// Links lists all outgoing links of a decoded block, found among its fields (including
+// nested blocks) of ChannelPointer type
+func Links(b Block) []Link {
+	return collectLinks(reflect.ValueOf(b), "")
+}
+
+func collectLinks(v reflect.Value, prefix string) []Link {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch {
+	case v.Type() == channelPointerType:
+		return []Link{{Attr: prefix, Target: v.Interface().(bctx.ChannelPointer).Id}}
+	case v.Kind() == reflect.Slice:
+		var result []Link
+		for i := 0; i < v.Len(); i++ {
+			result = append(result, collectLinks(v.Index(i), prefix)...)
+		}
+		return result
+	case v.Kind() == reflect.Struct:
+		var result []Link
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			// Embedded structs hold block's own state, like its input channel
+			if field.Anonymous {
+				continue
+			}
+			tag := field.Tag.Get("hcl")
+			if tag == "" {
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			result = append(result, collectLinks(v.Field(i), name)...)
+		}
+		return result
+	default:
+		return nil
+	}
+}
@@ -10,12 +10,12 @@ import (
 )
 
 type Log struct {
-	SingleChannelBlock
+	ProcessingBlock
 	Text hcl.Expression `hcl:"text"`
 }
 
 func (l *Log) Start(env *bctx.BEnv) error {
-	env.StartProcessing(l.Ch0(env), func(msg comm.Msg) error {
+	env.StartProcessing(&l.Lifecycle, l.Id, l.Ch0(env), l.Processing, func(msg comm.Msg) error {
 		val := msg.Value()
 
 		if !l.Text.Range().Empty() {
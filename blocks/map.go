@@ -7,7 +7,7 @@ import (
 )
 
 type Map struct {
-	SingleChannelBlock
+	ProcessingBlock
 	Expr   hcl.Expression      `hcl:"expr"`
 	SendTo bctx.ChannelPointer `hcl:"send_to"`
 }
@@ -15,7 +15,7 @@ type Map struct {
 func (m *Map) Start(env *bctx.BEnv) error {
 	sendTo := m.SendTo.SendCh(env)
 
-	env.StartProcessing(m.Ch0(env), func(msg comm.Msg) error {
+	env.StartProcessing(&m.Lifecycle, m.Id, m.Ch0(env), m.Processing, func(msg comm.Msg) error {
 		// Executing the expression
 		exprValue, err := bctx.EvaluateExpression(m.Expr, env.DefaultEvaluationContext(&msg))
 		if err != nil {
@@ -6,7 +6,7 @@ import (
 )
 
 type Mux struct {
-	SingleChannelBlock
+	ProcessingBlock
 	TerminateOnError bool                  `hcl:"terminate_on_error,optional"`
 	SendTo           []bctx.ChannelPointer `hcl:"send_to"`
 }
@@ -17,7 +17,7 @@ func (s *Mux) Start(env *bctx.BEnv) error {
 		sendTo = append(sendTo, s.SendCh(env))
 	}
 
-	env.StartProcessing(s.Ch0(env), func(msg comm.Msg) error {
+	env.StartProcessing(&s.Lifecycle, s.Id, s.Ch0(env), s.Processing, func(msg comm.Msg) error {
 		var reqs []sendRequest
 		for _, s := range sendTo {
 			reqs = append(reqs, sendRequest{
@@ -27,7 +27,7 @@ func (s *Mux) Start(env *bctx.BEnv) error {
 			})
 		}
 
-		result, _ := sendAll(s.TerminateOnError, reqs)
+		result, _ := sendAll(s.Id, s.TerminateOnError, reqs)
 
 		msg.Reply(result)
 
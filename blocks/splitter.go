@@ -7,7 +7,7 @@ import (
 )
 
 type Splitter struct {
-	SingleChannelBlock
+	ProcessingBlock
 	Expr             hcl.Expression      `hcl:"expr"`
 	SendTo           bctx.ChannelPointer `hcl:"send_to"`
 	TerminateOnError bool                `hcl:"terminate_on_error,optional"`
@@ -15,7 +15,7 @@ type Splitter struct {
 
 func (s *Splitter) Start(env *bctx.BEnv) error {
 	sendTo := s.SendTo.SendCh(env)
-	env.StartProcessing(s.Ch0(env), func(msg comm.Msg) error {
+	env.StartProcessing(&s.Lifecycle, s.Id, s.Ch0(env), s.Processing, func(msg comm.Msg) error {
 		val, err := bctx.EvaluateExpression(s.Expr, env.DefaultEvaluationContext(&msg))
 		if err != nil {
 			return err
@@ -31,7 +31,7 @@ func (s *Splitter) Start(env *bctx.BEnv) error {
 			})
 		}
 
-		result, _ := sendAll(s.TerminateOnError, reqs)
+		result, _ := sendAll(s.Id, s.TerminateOnError, reqs)
 
 		msg.Reply(result)
 
@@ -3,6 +3,9 @@ package blocks
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/dbolotin/deadmanswitch/bctx"
@@ -11,194 +14,864 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 )
 
 type Timer struct {
 	SingleChannelBlock
-	InitialTimeout *string              `hcl:"initial_timeout,optional"`
-	Timeout        hcl.Expression       `hcl:"timeout"`
-	RepeatAfter    *string              `hcl:"repeat_after,optional"`
-	BackoffFactor  float64              `hcl:"backoff_factor,optional"`
-	OnTimeout      *bctx.ChannelPointer `hcl:"on_timeout,optional"`
-	OnReset        *bctx.ChannelPointer `hcl:"on_reset,optional"`
-	OnRepeat       *bctx.ChannelPointer `hcl:"on_repeat,optional"`
+	// Key of the switch reset by the message, e.g. msg.url.job; each key has its own timer
+	Key            hcl.Expression `hcl:"key,optional"`
+	InitialTimeout *string        `hcl:"initial_timeout,optional"`
+	Timeout        hcl.Expression `hcl:"timeout,optional"`
+	RepeatAfter    *string        `hcl:"repeat_after,optional"`
+	BackoffFactor  float64        `hcl:"backoff_factor,optional"`
+	// Keys not reset for this long are forgotten, with their timers stopped
+	ForgetAfter *string `hcl:"forget_after,optional"`
+	// Number of keys having their own metrics, others are reported under the "_other" key;
+	// 100 by default
+	MetricsKeys *int                 `hcl:"metrics_keys,optional"`
+	OnTimeout   *bctx.ChannelPointer `hcl:"on_timeout,optional"`
+	OnReset     *bctx.ChannelPointer `hcl:"on_reset,optional"`
+	OnRepeat    *bctx.ChannelPointer `hcl:"on_repeat,optional"`
+	// Cron schedule of expected check-ins, used instead of the timeout, e.g. "0 3 * * *"
+	Schedule *string `hcl:"schedule,optional"`
+	// Time zone of the schedule, UTC by default
+	Timezone *string `hcl:"timezone,optional"`
+	// How late a check-in may arrive after the scheduled time before the timeout fires; 1h by
+	// default
+	Grace *string `hcl:"grace,optional"`
+	// How early a check-in may arrive before the scheduled time; equal to grace by default
+	EarlyGrace *string              `hcl:"early_grace,optional"`
+	OnEarly    *bctx.ChannelPointer `hcl:"on_early,optional"`
+	OnLate     *bctx.ChannelPointer `hcl:"on_late,optional"`
+	// Events of the actions taken via admin API
+	OnPause  *bctx.ChannelPointer `hcl:"on_pause,optional"`
+	OnResume *bctx.ChannelPointer `hcl:"on_resume,optional"`
+	OnSnooze *bctx.ChannelPointer `hcl:"on_snooze,optional"`
+	// Kind of the message: "start" of a run, its successful "finish" (the default) or "fail",
+	// e.g. msg.url.kind
+	Kind hcl.Expression `hcl:"kind,optional"`
+	// Runs not finished for this long are reported as "overrun" via on_timeout
+	MaxRuntime *string              `hcl:"max_runtime,optional"`
+	OnFail     *bctx.ChannelPointer `hcl:"on_fail,optional"`
+
+	onResetCh, onTimeoutCh, onRepeatCh chan<- comm.Msg
+	onPauseCh, onResumeCh, onSnoozeCh  chan<- comm.Msg
+	onEarlyCh, onLateCh, onFailCh      chan<- comm.Msg
+	repeatAfter                        time.Duration
+	maxRuntime                         time.Duration
+	schedule                           *timerSchedule
+
+	env     *bctx.BEnv
+	lock    sync.Mutex
+	states  map[string]*timerState
+	fired   chan timerFiring
+	metrics *timerMetrics
+	// Whether the state changed since it was last persisted
+	dirty        bool
+	saveRequests chan struct{}
+	// Whether the timer goroutine is done, so changes are persisted right away
+	stopped bool
+}
+
+// State of the timer of a single key
+type timerState struct {
+	key string
+	// Timeout set by the last reset
+	timeout time.Duration
+	// Current interval: the timeout, the delay of the next repeat or the snooze time
+	interval time.Duration
+	// Whether the timeout fired, so the timer now repeats
+	repeating bool
+	repeats   int
+	lastReset time.Time
+	// Last message of the key, of any kind
+	lastSeen time.Time
+	// Scheduled time of the awaited check-in, zero unless the timer has a schedule
+	expected time.Time
+	// Scheduled time that timed out while the timer awaits the following one, so a check-in
+	// before the window of the latter is late; zero if there is none
+	missed time.Time
+	// Paused timer doesn't fire until resumed; snoozed one is paused until the given time
+	paused      bool
+	pausedUntil time.Time
+	// When the timer fires next, zero if it's not armed
+	deadline time.Time
+	timer    *time.Timer
+	// Incremented each time the timer is re-armed, so firings of replaced timers are ignored
+	generation uint64
+	// Cancels context of the last event sent downstream
+	cancel context.CancelFunc
+
+	// Start of the run in progress, zero if there is none
+	started time.Time
+	// Whether the run in progress exceeded max_runtime
+	overran       bool
+	runTimer      *time.Timer
+	runGeneration uint64
+	// Cancels context of the last overrun event
+	runCancel context.CancelFunc
+}
+
+// State of the timer, as persisted in the state store
+type savedTimer struct {
+	Keyed bool                       `json:"keyed"`
+	Keys  map[string]savedTimerState `json:"keys"`
+}
+
+type savedTimerState struct {
+	Timeout     time.Duration `json:"timeout"`
+	Interval    time.Duration `json:"interval"`
+	Repeating   bool          `json:"repeating"`
+	Repeats     int           `json:"repeats"`
+	LastReset   time.Time     `json:"last_reset"`
+	LastSeen    time.Time     `json:"last_seen"`
+	Expected    time.Time     `json:"expected"`
+	Missed      time.Time     `json:"missed"`
+	Paused      bool          `json:"paused"`
+	PausedUntil time.Time     `json:"paused_until"`
+	Deadline    time.Time     `json:"deadline"`
+	Started     time.Time     `json:"started"`
+	Overran     bool          `json:"overran"`
+}
+
+type timerFiring struct {
+	key        string
+	generation uint64
+	// Firing of the max_runtime timer
+	run bool
+}
+
+// Event to be sent downstream
+type timerEvent struct {
+	to  chan<- comm.Msg
+	msg comm.Msg
 }
 
 var (
-	timerResetsVec   = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_reset"}, []string{"block"})
-	timerTimeoutsVec = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_timeout"}, []string{"block"})
-	timerRepeatsVec  = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_repeats"}, []string{"block"})
+	timerResetsVec   = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_reset"}, []string{"block", "key"})
+	timerTimeoutsVec = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_timeout"}, []string{"block", "key"})
+	timerRepeatsVec  = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_repeats"}, []string{"block", "key"})
+	timerFailsVec    = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_fail"}, []string{"block", "key"})
+	timerOverrunsVec = promauto.NewCounterVec(prometheus.CounterOpts{Name: "timer_overrun"}, []string{"block", "key"})
+	timerKeysVec     = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "timer_keys"}, []string{"block"})
 )
 
 const ZeroDuration = 0 * time.Minute
 
-func (t *Timer) Start(env *bctx.BEnv) error {
-	var err error
+// Delay of persisting the changed timer state, collecting the changes made meanwhile
+const timerSaveDelay = time.Second
 
-	initialTimeout := ZeroDuration
-	if t.InitialTimeout != nil {
-		initialTimeout, err = time.ParseDuration(*t.InitialTimeout)
-		if err != nil {
-			return err
+// Metrics label of keys above the limit
+const otherKeysLabel = "_other"
+
+// timerMetrics limits the number of keys labelling metrics of the timer
+type timerMetrics struct {
+	block    string
+	limit    int
+	labelled map[string]bool
+}
+
+func (m *timerMetrics) label(key string) string {
+	if m.labelled[key] {
+		return key
+	}
+	if len(m.labelled) >= m.limit {
+		return otherKeysLabel
+	}
+	m.labelled[key] = true
+	return key
+}
+
+// Metrics labelled by block and key
+var timerKeyVecs = []*prometheus.CounterVec{timerResetsVec, timerTimeoutsVec, timerRepeatsVec, timerFailsVec, timerOverrunsVec}
+
+// forget releases the label of the forgotten key, so another key can take it
+func (m *timerMetrics) forget(key string) {
+	if !m.labelled[key] {
+		return
+	}
+	delete(m.labelled, key)
+	for _, vec := range timerKeyVecs {
+		vec.DeleteLabelValues(m.block, key)
+	}
+}
+
+// deleteAll deletes all metrics of the block, once it's stopped
+func (m *timerMetrics) deleteAll() {
+	for _, vec := range timerKeyVecs {
+		for key := range m.labelled {
+			vec.DeleteLabelValues(m.block, key)
 		}
+		vec.DeleteLabelValues(m.block, otherKeysLabel)
 	}
+	m.labelled = make(map[string]bool)
+	timerKeysVec.DeleteLabelValues(m.block)
+}
 
-	repeatAfter := ZeroDuration
-	if t.RepeatAfter != nil {
-		repeatAfter, err = time.ParseDuration(*t.RepeatAfter)
-		if err != nil {
-			return err
+func (t *Timer) keyed() bool {
+	return !t.Key.Range().Empty()
+}
+
+func (t *Timer) Validate() []error {
+	var errs []error
+	if _, err := DurationOrDefault(t.InitialTimeout, ZeroDuration); err != nil {
+		errs = append(errs, &AttrError{Attr: "initial_timeout", Err: err})
+	}
+	if t.InitialTimeout != nil && t.keyed() {
+		errs = append(errs, &AttrError{Attr: "initial_timeout", Err: errors.New("can't be used with key, as keys are not known in advance")})
+	}
+	if _, err := DurationOrDefault(t.RepeatAfter, ZeroDuration); err != nil {
+		errs = append(errs, &AttrError{Attr: "repeat_after", Err: err})
+	}
+	if forgetAfter, err := DurationOrDefault(t.ForgetAfter, ZeroDuration); err != nil {
+		errs = append(errs, &AttrError{Attr: "forget_after", Err: err})
+	} else if forgetAfter < 0 {
+		errs = append(errs, &AttrError{Attr: "forget_after", Err: errors.New("must not be negative")})
+	}
+	if IntOrDefault(t.MetricsKeys, 100) < 0 {
+		errs = append(errs, &AttrError{Attr: "metrics_keys", Err: errors.New("must not be negative")})
+	}
+
+	if _, err := t.parseSchedule(); err != nil {
+		errs = append(errs, err)
+	}
+	if t.Timeout.Range().Empty() == (t.Schedule == nil) {
+		errs = append(errs, &AttrError{Attr: "timeout", Err: errors.New("exactly one of timeout and schedule must be set")})
+	}
+	if t.InitialTimeout != nil && t.Schedule != nil {
+		errs = append(errs, &AttrError{Attr: "initial_timeout", Err: errors.New("can't be used with schedule")})
+	}
+	if maxRuntime, err := DurationOrDefault(t.MaxRuntime, ZeroDuration); err != nil {
+		errs = append(errs, &AttrError{Attr: "max_runtime", Err: err})
+	} else if maxRuntime < 0 {
+		errs = append(errs, &AttrError{Attr: "max_runtime", Err: errors.New("must not be negative")})
+	}
+	if t.MaxRuntime != nil && t.Kind.Range().Empty() {
+		errs = append(errs, &AttrError{Attr: "max_runtime", Err: errors.New("can only be used with kind, as runs are started by \"start\" messages")})
+	}
+
+	// Timeout not depending on the message can be checked in advance
+	if !t.Timeout.Range().Empty() && len(t.Timeout.Variables()) == 0 {
+		if timeoutValue, diag := t.Timeout.Value(nil); !diag.HasErrors() {
+			if _, err := parseTimeout(timeoutValue); err != nil {
+				errs = append(errs, &AttrError{Attr: "timeout", Err: err})
+			}
+		}
+	}
+	if !t.Kind.Range().Empty() && len(t.Kind.Variables()) == 0 {
+		if kindValue, diag := t.Kind.Value(nil); !diag.HasErrors() {
+			if _, err := parseKind(kindValue); err != nil {
+				errs = append(errs, &AttrError{Attr: "kind", Err: err})
+			}
 		}
 	}
 
+	return errs
+}
+
+func (t *Timer) Start(env *bctx.BEnv) error {
+	initialTimeout, err := DurationOrDefault(t.InitialTimeout, ZeroDuration)
+	if err != nil {
+		return err
+	}
+
+	repeatAfter, err := DurationOrDefault(t.RepeatAfter, ZeroDuration)
+	if err != nil {
+		return err
+	}
+
+	forgetAfter, err := DurationOrDefault(t.ForgetAfter, ZeroDuration)
+	if err != nil {
+		return err
+	}
+
+	maxRuntime, err := DurationOrDefault(t.MaxRuntime, ZeroDuration)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := t.parseSchedule()
+	if err != nil {
+		return err
+	}
+
+	// Admin API may access the timer while it's being started; it's treated as running once
+	// its states are set
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	// BackoffFactor must be greater then one
 	if t.BackoffFactor < 1 {
 		t.BackoffFactor = 1
 	}
 
-	// Monitoring
-	pLabels := prometheus.Labels{
-		"block": t.Id,
+	t.repeatAfter = repeatAfter
+	t.maxRuntime = maxRuntime
+	t.schedule = schedule
+	t.env = env
+	t.fired = make(chan timerFiring)
+	t.saveRequests = make(chan struct{}, 1)
+	t.metrics = &timerMetrics{
+		block:    t.Id,
+		limit:    IntOrDefault(t.MetricsKeys, 100),
+		labelled: make(map[string]bool),
 	}
-	mResets := timerResetsVec.With(pLabels)
-	mTimeouts := timerTimeoutsVec.With(pLabels)
-	mRepeats := timerRepeatsVec.With(pLabels)
-
-	var onResetCh, onTimeoutCh, onRepeatCh chan<- comm.Msg
+	t.AfterStop(func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.metrics.deleteAll()
+	})
 
 	if t.OnReset != nil {
-		onResetCh = t.OnReset.SendCh(env)
+		t.onResetCh = t.OnReset.SendCh(env)
 	}
 	if t.OnTimeout != nil {
-		onTimeoutCh = t.OnTimeout.SendCh(env)
+		t.onTimeoutCh = t.OnTimeout.SendCh(env)
 	}
 	if t.OnRepeat != nil {
-		onRepeatCh = t.OnRepeat.SendCh(env)
+		t.onRepeatCh = t.OnRepeat.SendCh(env)
+	}
+	if t.OnEarly != nil {
+		t.onEarlyCh = t.OnEarly.SendCh(env)
+	}
+	if t.OnLate != nil {
+		t.onLateCh = t.OnLate.SendCh(env)
 	}
+	if t.OnPause != nil {
+		t.onPauseCh = t.OnPause.SendCh(env)
+	}
+	if t.OnResume != nil {
+		t.onResumeCh = t.OnResume.SendCh(env)
+	}
+	if t.OnSnooze != nil {
+		t.onSnoozeCh = t.OnSnooze.SendCh(env)
+	}
+	if t.OnFail != nil {
+		t.onFailCh = t.OnFail.SendCh(env)
+	}
+	t.states = make(map[string]*timerState)
 
 	ch0 := t.Ch0(env)
-	go func() {
-		var timer *time.Timer = nil
-		var timerChannel <-chan time.Time = nil
-		var cancelCurrentRequest context.CancelFunc = nil
-
-		if initialTimeout != ZeroDuration {
-			timer = time.NewTimer(initialTimeout)
-			timerChannel = timer.C
-			cancelCurrentRequest = sendTimerMsg("reset", initialTimeout, onResetCh)
+	t.Go(func() {
+		var sweep <-chan time.Time
+		if forgetAfter != ZeroDuration {
+			ticker := time.NewTicker(sweepInterval(forgetAfter))
+			defer ticker.Stop()
+			sweep = ticker.C
 		}
 
-		currentTimeout := initialTimeout
-		isOnRepeat := false
+		// Timers restored from the state store take precedence over the initial timeout; timer
+		// with a schedule awaits the first scheduled check-in right away
+		t.lock.Lock()
+		events := t.restore(time.Now())
+		if _, restored := t.states[""]; !restored && !t.keyed() {
+			if t.schedule != nil {
+				now := time.Now()
+				t.await(t.state(""), t.schedule.Next(now), now)
+			} else if initialTimeout != ZeroDuration {
+				events = append(events, t.reset("", initialTimeout, noDuration, time.Now())...)
+			}
+		}
+		t.save()
+		t.lock.Unlock()
+		t.send(events)
 
+		// Pending write of the changed state
+		var flush <-chan time.Time
 		for {
 			select {
-			case msg := <-ch0:
-				mResets.Inc()
-				isOnRepeat = false
-
-				// Executing timeout expression
-				timeoutValue, err := bctx.EvaluateExpression(t.Timeout, env.DefaultEvaluationContext(&msg))
-				if err != nil {
-					env.WriteError(err)
-					msg.ReplyWithError()
-					continue
-				}
+			case <-t.Done():
+				// Block stopped; notifications already sent downstream are not cancelled
+				t.stopTimers()
+				t.flush(true)
+				return
 
-				if timeoutValue.Type() == cty.String {
-					currentTimeout, err = time.ParseDuration(timeoutValue.AsString())
-					if err != nil {
-						env.WriteError(err)
-						msg.ReplyWithError()
-						continue
-					}
-				} else if timeoutValue.Type() == cty.Number {
-					val, _ := timeoutValue.AsBigFloat().Int64()
-					currentTimeout = time.Duration(val) * time.Second
-				} else {
-					if err != nil {
-						env.WriteError(errors.New("Wrong timeout type: " + timeoutValue.Type().GoString()))
-						msg.ReplyWithError()
-						continue
-					}
+			case <-t.saveRequests:
+				if flush == nil {
+					flush = time.After(timerSaveDelay)
 				}
 
-				// Cancelling context of previously sent downstream requests
-				if cancelCurrentRequest != nil {
-					cancelCurrentRequest()
-					cancelCurrentRequest = nil
-				}
+			case <-flush:
+				flush = nil
+				t.flush(false)
 
-				// Resetting timer
-				if timer != nil {
-					timer.Stop()
-					timer = nil
-					timerChannel = nil
-				}
+			case msg := <-ch0:
+				t.handle(env, msg)
 
-				if currentTimeout != ZeroDuration {
-					timer = time.NewTimer(currentTimeout)
-					timerChannel = timer.C
-					cancelCurrentRequest = sendTimerMsg("reset", currentTimeout, onResetCh)
-				}
+			case f := <-t.fired:
+				t.lock.Lock()
+				events := t.fire(f)
+				t.save()
+				t.lock.Unlock()
+				t.send(events)
 
-				// Reporting to the upstream block that we processed the message
-				msg.Close()
-
-			case <-timerChannel:
-				var event string
-				var targetCh chan<- comm.Msg
-				if isOnRepeat {
-					mRepeats.Inc()
-					event = "repeat"
-					currentTimeout = time.Duration(t.BackoffFactor * float64(currentTimeout))
-					targetCh = onRepeatCh
-				} else {
-					mTimeouts.Inc()
-					event = "timeout"
-					currentTimeout = repeatAfter
-					targetCh = onTimeoutCh
+			case now := <-sweep:
+				t.lock.Lock()
+				if t.forgetStale(now, forgetAfter) {
+					t.save()
 				}
+				t.lock.Unlock()
+			}
+		}
+	})
 
-				// Cancelling context of previously sent downstream request
-				if cancelCurrentRequest != nil {
-					cancelCurrentRequest()
-					cancelCurrentRequest = nil
-				}
+	return nil
+}
 
-				if timer != nil {
-					timer.Stop()
-					timer = nil
-					timerChannel = nil
-				}
+// handle resets timer of the key of the message, or starts or ends its run according to the
+// kind of the message
+func (t *Timer) handle(env *bctx.BEnv, msg comm.Msg) {
+	evCtx := env.DefaultEvaluationContext(&msg)
 
-				isOnRepeat = true
-				if currentTimeout != ZeroDuration {
-					timer = time.NewTimer(currentTimeout)
-					timerChannel = timer.C
-				}
+	key := ""
+	if t.keyed() {
+		keyValue, err := bctx.EvaluateExpression(t.Key, evCtx)
+		if err == nil {
+			key, err = parseKey(keyValue)
+			if err != nil {
+				err = comm.NewError(comm.ErrorEvaluation, err)
+			}
+		}
+		if err != nil {
+			env.WriteError(err)
+			msg.ReplyWithError(comm.AsError(t.Id, err))
+			return
+		}
+	}
 
-				cancelCurrentRequest = sendTimerMsg(event, currentTimeout, targetCh)
+	kind := timerFinish
+	if !t.Kind.Range().Empty() {
+		kindValue, err := bctx.EvaluateExpression(t.Kind, evCtx)
+		if err == nil {
+			kind, err = parseKind(kindValue)
+			if err != nil {
+				err = comm.NewError(comm.ErrorEvaluation, err)
 			}
 		}
-	}()
+		if err != nil {
+			env.WriteError(err)
+			msg.ReplyWithError(comm.AsError(t.Id, err))
+			return
+		}
+	}
 
-	return nil
+	// Executing timeout expression; only finish of the run resets the timeout
+	var timeout time.Duration
+	if kind == timerFinish && t.schedule == nil {
+		timeoutValue, err := bctx.EvaluateExpression(t.Timeout, evCtx)
+		if err != nil {
+			env.WriteError(err)
+			msg.ReplyWithError(comm.AsError(t.Id, err))
+			return
+		}
+
+		timeout, err = parseTimeout(timeoutValue)
+		if err != nil {
+			env.WriteError(err)
+			msg.ReplyWithError(comm.AsError(t.Id, comm.NewError(comm.ErrorEvaluation, err)))
+			return
+		}
+	}
+
+	t.lock.Lock()
+	now := time.Now()
+	var events []timerEvent
+	switch kind {
+	case timerStart:
+		events = t.startRun(key, now)
+	case timerFail:
+		timerFailsVec.WithLabelValues(t.Id, t.metrics.label(key)).Inc()
+		events = t.failRun(key, now)
+	default:
+		timerResetsVec.WithLabelValues(t.Id, t.metrics.label(key)).Inc()
+		duration := t.finishRun(t.state(key), now)
+		if t.schedule != nil {
+			events = t.checkIn(key, duration, now)
+		} else {
+			events = t.reset(key, timeout, duration, now)
+		}
+	}
+	t.save()
+	t.lock.Unlock()
+	t.send(events)
+
+	// Reporting to the upstream block that we processed the message
+	msg.Close()
+}
+
+// reset restarts timer of the key with the given timeout, zero timeout disarms it; duration
+// of the finished run, if known, is reported in the event. Paused timer only records the
+// reset, its timeout starts over when it's resumed. Must be called with the lock held.
+func (t *Timer) reset(key string, timeout time.Duration, duration cty.Value, now time.Time) []timerEvent {
+	st := t.state(key)
+	st.timeout = timeout
+	st.lastReset = now
+	st.lastSeen = now
+	if st.paused {
+		return nil
+	}
+
+	st.interval = timeout
+	st.repeating = false
+	st.repeats = 0
+	t.arm(st, timeout, now)
+
+	if timeout == ZeroDuration {
+		t.cancelEvent(st)
+		return nil
+	}
+	return t.timedEvent(st, "reset", t.onResetCh, false, duration)
+}
+
+// state returns state of the key, creating it if the key is new; must be called with the lock
+// held
+func (t *Timer) state(key string) *timerState {
+	st, ok := t.states[key]
+	if !ok {
+		st = &timerState{key: key}
+		t.states[key] = st
+		timerKeysVec.WithLabelValues(t.Id).Set(float64(len(t.states)))
+	}
+	return st
+}
+
+// fire handles expiration of the timer: the first one after reset is the timeout, the
+// following ones are repeats, each delayed by the backoff factor more than the previous one;
+// must be called with the lock held
+func (t *Timer) fire(f timerFiring) []timerEvent {
+	st, ok := t.states[f.key]
+	if ok && f.run && st.runGeneration == f.generation {
+		return t.checkRun(st, time.Now(), false)
+	}
+	if !ok || f.run || st.generation != f.generation {
+		// Timer was reset or forgotten meanwhile
+		return nil
+	}
+	if st.paused {
+		// Snooze is over
+		return t.resume(st, false)
+	}
+	return t.expire(st, false, time.Now())
+}
+
+// expire emits the timeout or repeat event of the key and schedules the next repeat; recovered
+// events are the ones that were due while hookblock wasn't running
+func (t *Timer) expire(st *timerState, recovered bool, now time.Time) []timerEvent {
+	var event string
+	var targetCh chan<- comm.Msg
+	if st.repeating {
+		timerRepeatsVec.WithLabelValues(t.Id, t.metrics.label(st.key)).Inc()
+		event = "repeat"
+		st.repeats++
+		st.interval = time.Duration(t.BackoffFactor * float64(st.interval))
+		targetCh = t.onRepeatCh
+	} else {
+		timerTimeoutsVec.WithLabelValues(t.Id, t.metrics.label(st.key)).Inc()
+		event = "timeout"
+		st.interval = t.repeatAfter
+		targetCh = t.onTimeoutCh
+
+		if t.schedule != nil && t.repeatAfter == ZeroDuration {
+			// Without repeats, timer with a schedule awaits the following scheduled time, so a
+			// job that stays down is reported for each time it misses
+			events := t.event(st, event, targetCh, recovered)
+			missed := st.expected
+			next := t.schedule.upcoming(now)
+			if !next.After(missed) {
+				next = t.schedule.Next(missed)
+			}
+			t.await(st, next, now)
+			st.missed = missed
+			return events
+		}
+	}
+
+	st.repeating = true
+	t.arm(st, st.interval, now)
+	return t.event(st, event, targetCh, recovered)
 }
 
-func sendTimerMsg(event string, timeout time.Duration, to chan<- comm.Msg) context.CancelFunc {
+// arm (re)starts timer of the key, zero duration leaves it stopped
+func (t *Timer) arm(st *timerState, d time.Duration, now time.Time) {
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	st.generation++
+	st.deadline = time.Time{}
+	if d == ZeroDuration {
+		return
+	}
+
+	st.deadline = now.Add(d)
+	st.timer = t.after(d, timerFiring{key: st.key, generation: st.generation})
+}
+
+// after delivers the firing to the timer goroutine once the duration elapses
+func (t *Timer) after(d time.Duration, f timerFiring) *time.Timer {
+	return time.AfterFunc(d, func() {
+		select {
+		case t.fired <- f:
+		case <-t.Done():
+		}
+	})
+}
+
+// cancelEvent cancels context of the previously sent downstream event
+func (t *Timer) cancelEvent(st *timerState) {
+	if st.cancel != nil {
+		st.cancel()
+		st.cancel = nil
+	}
+}
+
+// event creates the event for the key, cancelling the previous one
+func (t *Timer) event(st *timerState, event string, to chan<- comm.Msg, recovered bool) []timerEvent {
+	return t.timedEvent(st, event, to, recovered, noDuration)
+}
+
+// timedEvent creates the event reporting duration of the run, cancelling the previous one
+func (t *Timer) timedEvent(st *timerState, event string, to chan<- comm.Msg, recovered bool, duration cty.Value) []timerEvent {
+	t.cancelEvent(st)
 	if to == nil {
 		return nil
 	}
+	e, cancel := t.newEvent(st, event, to, recovered, duration)
+	st.cancel = cancel
+	return []timerEvent{e}
+}
+
+// newEvent creates the event message, having its own context
+func (t *Timer) newEvent(st *timerState, event string, to chan<- comm.Msg, recovered bool, duration cty.Value) (timerEvent, context.CancelFunc) {
+
+	key := cty.NullVal(cty.String)
+	if t.keyed() {
+		key = cty.StringVal(st.key)
+	}
+	scheduled := cty.NullVal(cty.String)
+	if !st.expected.IsZero() {
+		scheduled = cty.StringVal(st.expected.Format(time.RFC3339))
+	}
+
+	cCtx, cancel := context.WithCancel(context.Background())
+	return timerEvent{
+		to: to,
+		msg: comm.NewMessageNoC(
+			cCtx,
+			cty.ObjectVal(map[string]cty.Value{
+				"event":     cty.StringVal(event),
+				"key":       key,
+				"timeout":   cty.NumberFloatVal(float64(st.interval) / float64(time.Second)),
+				"recovered": cty.BoolVal(recovered),
+				"scheduled": scheduled,
+				"duration":  duration,
+			}),
+		),
+	}, cancel
+}
 
-	cCtx, cancelCurrentRequest := context.WithCancel(context.Background())
-	to <- comm.NewMessageNoC(
-		cCtx,
-		cty.ObjectVal(map[string]cty.Value{
-			"event":   cty.StringVal(event),
-			"timeout": cty.NumberFloatVal(float64(timeout) / float64(time.Second)),
-		}),
-	)
+// send delivers events downstream, unless the block is stopped
+func (t *Timer) send(events []timerEvent) {
+	for _, e := range events {
+		select {
+		case e.to <- e.msg:
+		case <-t.Done():
+			return
+		}
+	}
+}
 
-	return cancelCurrentRequest
+// forgetStale drops keys not reset for the given time, returns whether any were dropped; must
+// be called with the lock held
+func (t *Timer) forgetStale(now time.Time, forgetAfter time.Duration) bool {
+	forgotten := false
+	for key, st := range t.states {
+		if st.paused || now.Sub(st.lastSeen) < forgetAfter {
+			continue
+		}
+		st.stop()
+		delete(t.states, key)
+		t.metrics.forget(key)
+		forgotten = true
+	}
+	timerKeysVec.WithLabelValues(t.Id).Set(float64(len(t.states)))
+	return forgotten
+}
+
+// save marks state of the timer as changed, to be persisted by the timer goroutine shortly, so
+// that bursts of changes are written at once; does nothing if state store isn't configured.
+// Changes made after the timer goroutine is done, e.g. via admin API while the block stops,
+// are written right away. Must be called with the lock held.
+func (t *Timer) save() {
+	if t.env.StateStore() == nil {
+		return
+	}
+	if t.stopped {
+		t.dirty = false
+		t.write(t.snapshot())
+		return
+	}
+	if t.dirty {
+		return
+	}
+	t.dirty = true
+	select {
+	case t.saveRequests <- struct{}{}:
+	default:
+	}
+}
+
+// flush persists state of all keys, if it changed since the last flush; the state file is
+// written without holding the lock. Final flush marks the timer stopped.
+func (t *Timer) flush(final bool) {
+	t.lock.Lock()
+	t.stopped = final
+	if !t.dirty {
+		t.lock.Unlock()
+		return
+	}
+	t.dirty = false
+	saved := t.snapshot()
+	t.lock.Unlock()
+
+	t.write(saved)
+}
+
+// write persists the state to the state store
+func (t *Timer) write(saved savedTimer) {
+	store := t.env.StateStore()
+	if store == nil {
+		return
+	}
+	if err := store.Save(t.Id, saved); err != nil {
+		t.env.WriteError(fmt.Errorf("error saving state of %s: %s", t.Id, err))
+	}
+}
+
+// snapshot returns state of all keys in the persisted form; must be called with the lock held
+func (t *Timer) snapshot() savedTimer {
+	saved := savedTimer{Keyed: t.keyed(), Keys: make(map[string]savedTimerState)}
+	for key, st := range t.states {
+		saved.Keys[key] = savedTimerState{
+			Timeout:     st.timeout,
+			Interval:    st.interval,
+			Repeating:   st.repeating,
+			Repeats:     st.repeats,
+			LastReset:   st.lastReset,
+			LastSeen:    st.lastSeen,
+			Expected:    st.expected,
+			Missed:      st.missed,
+			Paused:      st.paused,
+			PausedUntil: st.pausedUntil,
+			Deadline:    st.deadline,
+			Started:     st.started,
+			Overran:     st.overran,
+		}
+	}
+	return saved
+}
+
+// restore re-arms timers saved in the state store; timers that expired meanwhile fire
+// immediately. Must be called with the lock held.
+func (t *Timer) restore(now time.Time) []timerEvent {
+	store := t.env.StateStore()
+	if store == nil {
+		return nil
+	}
+
+	var saved savedTimer
+	found, err := store.Load(t.Id, &saved)
+	if err != nil {
+		t.env.WriteError(fmt.Errorf("error restoring state of %s: %s", t.Id, err))
+		return nil
+	}
+	// Keys can't be restored into a timer that is no longer keyed, and vice versa
+	if !found || saved.Keyed != t.keyed() {
+		return nil
+	}
+
+	var events []timerEvent
+	for key, s := range saved.Keys {
+		st := &timerState{
+			key:         key,
+			timeout:     s.Timeout,
+			interval:    s.Interval,
+			repeating:   s.Repeating,
+			repeats:     s.Repeats,
+			lastReset:   s.LastReset,
+			lastSeen:    s.LastSeen,
+			expected:    s.Expected,
+			missed:      s.Missed,
+			paused:      s.Paused,
+			pausedUntil: s.PausedUntil,
+			started:     s.Started,
+			overran:     s.Overran,
+		}
+		if st.lastSeen.IsZero() {
+			// Saved before the runs were tracked
+			st.lastSeen = st.lastReset
+		}
+		t.states[key] = st
+
+		if !s.Deadline.IsZero() {
+			if s.Deadline.After(now) {
+				t.arm(st, s.Deadline.Sub(now), now)
+			} else if st.paused {
+				events = append(events, t.resume(st, true)...)
+			} else {
+				events = append(events, t.expire(st, true, now)...)
+			}
+		}
+		events = append(events, t.checkRun(st, now, true)...)
+	}
+	timerKeysVec.WithLabelValues(t.Id).Set(float64(len(t.states)))
+
+	if len(t.states) != 0 {
+		log.Printf("Restored state of %d timer(s) of %s", len(t.states), t.Id)
+	}
+	return events
+}
+
+func (t *Timer) stopTimers() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, st := range t.states {
+		st.stop()
+	}
+}
+
+// Stale keys are looked for at a fraction of forget_after, within reasonable bounds
+func sweepInterval(forgetAfter time.Duration) time.Duration {
+	d := forgetAfter / 10
+	if d < time.Second {
+		d = time.Second
+	}
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+func parseKey(value cty.Value) (string, error) {
+	if !value.IsKnown() || value.IsNull() {
+		return "", errors.New("key is null")
+	}
+	value, err := convert.Convert(value, cty.String)
+	if err != nil {
+		return "", errors.New("key must be a string")
+	}
+	return value.AsString(), nil
+}
+
+// Timeout is either a duration string or a number of seconds
+func parseTimeout(value cty.Value) (time.Duration, error) {
+	if value.Type() == cty.String && value.IsKnown() && !value.IsNull() {
+		return time.ParseDuration(value.AsString())
+	} else if value.Type() == cty.Number && value.IsKnown() && !value.IsNull() {
+		val, _ := value.AsBigFloat().Int64()
+		return time.Duration(val) * time.Second, nil
+	} else {
+		return ZeroDuration, errors.New("Wrong timeout type: " + value.Type().GoString())
+	}
 }
@@ -0,0 +1,226 @@
+package blocks
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Actions on a timer key, taken via admin API
+const (
+	TimerReset  = "reset"
+	TimerPause  = "pause"
+	TimerResume = "resume"
+	TimerSnooze = "snooze"
+	TimerFire   = "fire"
+)
+
+var (
+	ErrUnknownTimerKey    = errors.New("unknown key")
+	ErrUnknownTimerAction = errors.New("unknown action")
+	ErrTimerNotRunning    = errors.New("timer is not running")
+	ErrTimerPaused        = errors.New("timer is paused")
+	ErrTimerNotPaused     = errors.New("timer is not paused")
+	ErrTimerNoTimeout     = errors.New("timeout must be given for a key that was never reset")
+	ErrTimerSnoozePast    = errors.New("snooze time must be in the future")
+)
+
+// TimerStatus describes the timer of a key
+type TimerStatus struct {
+	Key string `json:"key"`
+	// "armed", "repeating", "paused", "snoozed" or "idle"
+	State string `json:"state"`
+	// Timeout set by the last reset, in seconds
+	Timeout float64 `json:"timeout"`
+	// Current interval: the timeout, the delay of the next repeat grown by the backoff or the
+	// snooze time, in seconds
+	Interval  float64    `json:"interval"`
+	Repeats   int        `json:"repeats"`
+	LastReset *time.Time `json:"last_reset"`
+	// Scheduled time of the awaited check-in, for timers with a schedule
+	Scheduled   *time.Time `json:"scheduled,omitempty"`
+	Deadline    *time.Time `json:"deadline"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+	// Start of the run in progress
+	Started *time.Time `json:"started,omitempty"`
+	// Whether the run in progress exceeded max_runtime
+	Overran bool `json:"overran,omitempty"`
+}
+
+// TimerControl holds parameters of a timer action
+type TimerControl struct {
+	// Timeout of the reset; the last one of the key is used if zero
+	Timeout time.Duration
+	// End of the snooze
+	Until time.Time
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (st *timerState) status() TimerStatus {
+	state := "idle"
+	switch {
+	case st.paused && !st.pausedUntil.IsZero():
+		state = "snoozed"
+	case st.paused:
+		state = "paused"
+	case st.deadline.IsZero():
+	case st.repeating:
+		state = "repeating"
+	default:
+		state = "armed"
+	}
+	return TimerStatus{
+		Key:         st.key,
+		State:       state,
+		Timeout:     st.timeout.Seconds(),
+		Interval:    st.interval.Seconds(),
+		Repeats:     st.repeats,
+		LastReset:   timePtr(st.lastReset),
+		Scheduled:   timePtr(st.expected),
+		Deadline:    timePtr(st.deadline),
+		PausedUntil: timePtr(st.pausedUntil),
+		Started:     timePtr(st.started),
+		Overran:     st.overran,
+	}
+}
+
+// Keyed tells whether the timer keeps a separate state for each key
+func (t *Timer) Keyed() bool {
+	return t.keyed()
+}
+
+// Status describes timers of all keys, ordered by key
+func (t *Timer) Status() []TimerStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	result := []TimerStatus{}
+	for _, st := range t.states {
+		result = append(result, st.status())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// Control takes the action on the timer of the key and sends the corresponding event
+// downstream: reset restarts the timeout (or checks in, if the timer has a schedule), pause stops the timer until it's resumed, snooze
+// pauses it until the given time, and fire makes it expire immediately
+func (t *Timer) Control(action string, key string, c TimerControl) (TimerStatus, error) {
+	t.lock.Lock()
+	events, status, err := t.control(action, key, c, time.Now())
+	if err == nil {
+		t.save()
+	}
+	t.lock.Unlock()
+
+	t.send(events)
+	return status, err
+}
+
+// control takes the action; must be called with the lock held
+func (t *Timer) control(action string, key string, c TimerControl, now time.Time) ([]timerEvent, TimerStatus, error) {
+	if t.states == nil {
+		return nil, TimerStatus{}, ErrTimerNotRunning
+	}
+
+	st, exists := t.states[key]
+	if !exists && action != TimerReset {
+		return nil, TimerStatus{}, ErrUnknownTimerKey
+	}
+
+	var events []timerEvent
+	switch action {
+	case TimerReset:
+		if t.schedule != nil {
+			if exists {
+				st.paused = false
+				st.pausedUntil = time.Time{}
+			}
+			timerResetsVec.WithLabelValues(t.Id, t.metrics.label(key)).Inc()
+			events = t.checkIn(key, noDuration, now)
+			st = t.states[key]
+			break
+		}
+
+		timeout := c.Timeout
+		if timeout == ZeroDuration {
+			if !exists {
+				return nil, TimerStatus{}, ErrTimerNoTimeout
+			}
+			timeout = st.timeout
+		}
+		if exists {
+			st.paused = false
+			st.pausedUntil = time.Time{}
+		}
+		timerResetsVec.WithLabelValues(t.Id, t.metrics.label(key)).Inc()
+		events = t.reset(key, timeout, noDuration, now)
+		st = t.states[key]
+
+	case TimerPause:
+		if st.paused && st.pausedUntil.IsZero() {
+			// Already paused
+			break
+		}
+		st.paused = true
+		st.pausedUntil = time.Time{}
+		st.interval = ZeroDuration
+		t.arm(st, ZeroDuration, now)
+		t.checkRun(st, now, false)
+		events = t.event(st, "pause", t.onPauseCh, false)
+
+	case TimerSnooze:
+		if !c.Until.After(now) {
+			return nil, TimerStatus{}, ErrTimerSnoozePast
+		}
+		st.paused = true
+		st.pausedUntil = c.Until
+		st.interval = c.Until.Sub(now)
+		t.arm(st, st.interval, now)
+		t.checkRun(st, now, false)
+		events = t.event(st, "snooze", t.onSnoozeCh, false)
+
+	case TimerResume:
+		if !st.paused {
+			return nil, TimerStatus{}, ErrTimerNotPaused
+		}
+		events = t.resume(st, false)
+
+	case TimerFire:
+		if st.paused {
+			return nil, TimerStatus{}, ErrTimerPaused
+		}
+		events = t.expire(st, false, time.Now())
+
+	default:
+		return nil, TimerStatus{}, ErrUnknownTimerAction
+	}
+
+	return events, st.status(), nil
+}
+
+// resume unpauses the timer, starting its timeout over; run in progress that exceeded
+// max_runtime meanwhile is reported right away. Recovered resume is the one of the snooze
+// that ended while hookblock wasn't running. Must be called with the lock held.
+func (t *Timer) resume(st *timerState, recovered bool) []timerEvent {
+	st.paused = false
+	st.pausedUntil = time.Time{}
+	if t.schedule != nil {
+		t.await(st, t.schedule.upcoming(time.Now()), time.Now())
+	} else {
+		st.interval = st.timeout
+		st.repeating = false
+		st.repeats = 0
+		t.arm(st, st.timeout, time.Now())
+	}
+	events := t.event(st, "resume", t.onResumeCh, recovered)
+	return append(events, t.checkRun(st, time.Now(), recovered)...)
+}
@@ -0,0 +1,155 @@
+package blocks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Kinds of messages received by the timer
+const (
+	timerStart  = "start"
+	timerFinish = "finish"
+	timerFail   = "fail"
+)
+
+// Duration of the run that didn't report its start
+var noDuration = cty.NullVal(cty.Number)
+
+// Kind is "start", "finish" or "fail"; null kind is "finish"
+func parseKind(value cty.Value) (string, error) {
+	if value.IsKnown() && value.IsNull() {
+		return timerFinish, nil
+	}
+	if !value.IsKnown() || value.Type() != cty.String {
+		return "", errors.New("kind must be a string")
+	}
+	switch kind := value.AsString(); kind {
+	case timerStart, timerFinish, timerFail:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("unknown kind \"%s\", must be \"start\", \"finish\" or \"fail\"", kind)
+	}
+}
+
+// stop stops both timers of the key
+func (st *timerState) stop() {
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	if st.runTimer != nil {
+		st.runTimer.Stop()
+	}
+}
+
+// startRun records start of the run of the key, replacing the one in progress, and arms its
+// max_runtime timer; must be called with the lock held
+func (t *Timer) startRun(key string, now time.Time) []timerEvent {
+	st := t.state(key)
+	st.lastSeen = now
+	st.started = now
+	st.overran = false
+	t.cancelRunEvent(st)
+	return t.checkRun(st, now, false)
+}
+
+// finishRun ends the run in progress, returning its duration in seconds, null if the start of
+// the run wasn't reported; must be called with the lock held
+func (t *Timer) finishRun(st *timerState, now time.Time) cty.Value {
+	duration := noDuration
+	if !st.started.IsZero() {
+		duration = cty.NumberFloatVal(now.Sub(st.started).Seconds())
+	}
+	st.started = time.Time{}
+	st.overran = false
+	t.armRun(st, ZeroDuration)
+	t.cancelRunEvent(st)
+	return duration
+}
+
+// failRun ends the run of the key as failed. Failure is reported right away and the timer goes
+// on as if it timed out, repeating until the next successful run. Without repeat_after, the
+// timer waits for the next run for its timeout, as after a reset. Timer with a schedule takes
+// the failed run for the awaited scheduled time and awaits the following one. Paused timer only
+// records the end of the run. Must be called with the lock held.
+func (t *Timer) failRun(key string, now time.Time) []timerEvent {
+	st := t.state(key)
+	st.lastSeen = now
+	duration := t.finishRun(st, now)
+	if st.paused {
+		return nil
+	}
+
+	switch {
+	case t.schedule != nil:
+		upcoming := t.schedule.upcoming(now)
+		if !upcoming.IsZero() && !now.Before(upcoming.Add(-t.schedule.earlyGrace)) {
+			upcoming = t.schedule.Next(upcoming)
+		}
+		t.await(st, upcoming, now)
+
+	case t.repeatAfter == ZeroDuration:
+		st.repeating = false
+		st.repeats = 0
+		st.interval = st.timeout
+		t.arm(st, st.interval, now)
+
+	default:
+		if !st.repeating {
+			st.repeating = true
+			st.interval = t.repeatAfter
+		}
+		t.arm(st, st.interval, now)
+	}
+	return t.timedEvent(st, "fail", t.onFailCh, false, duration)
+}
+
+// checkRun arms max_runtime timer of the run in progress, or reports the run as overrun if its
+// time is already over; runs of paused timers are not watched. Recovered overrun is the one
+// that happened while hookblock wasn't running. Must be called with the lock held.
+func (t *Timer) checkRun(st *timerState, now time.Time, recovered bool) []timerEvent {
+	if st.started.IsZero() || st.overran || st.paused || t.maxRuntime == ZeroDuration {
+		t.armRun(st, ZeroDuration)
+		return nil
+	}
+	if remaining := st.started.Add(t.maxRuntime).Sub(now); remaining > 0 {
+		t.armRun(st, remaining)
+		return nil
+	}
+
+	t.armRun(st, ZeroDuration)
+	st.overran = true
+	timerOverrunsVec.WithLabelValues(t.Id, t.metrics.label(st.key)).Inc()
+
+	// Overrun doesn't cancel the events of the timeout, it's cancelled by the end of the run
+	t.cancelRunEvent(st)
+	if t.onTimeoutCh == nil {
+		return nil
+	}
+	e, cancel := t.newEvent(st, "overrun", t.onTimeoutCh, recovered, cty.NumberFloatVal(now.Sub(st.started).Seconds()))
+	st.runCancel = cancel
+	return []timerEvent{e}
+}
+
+// armRun (re)starts max_runtime timer of the key, zero duration leaves it stopped
+func (t *Timer) armRun(st *timerState, d time.Duration) {
+	if st.runTimer != nil {
+		st.runTimer.Stop()
+		st.runTimer = nil
+	}
+	st.runGeneration++
+	if d == ZeroDuration {
+		return
+	}
+	st.runTimer = t.after(d, timerFiring{key: st.key, generation: st.runGeneration, run: true})
+}
+
+// cancelRunEvent cancels context of the previously sent overrun event
+func (t *Timer) cancelRunEvent(st *timerState) {
+	if st.runCancel != nil {
+		st.runCancel()
+		st.runCancel = nil
+	}
+}
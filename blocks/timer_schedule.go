@@ -0,0 +1,124 @@
+package blocks
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dbolotin/deadmanswitch/cron"
+	"github.com/zclconf/go-cty/cty"
+)
+
+var (
+	errSetWithoutSchedule = errors.New("can only be used with schedule")
+	errNegativeGrace      = errors.New("grace must not be negative")
+)
+
+// timerSchedule defines windows check-ins are expected in: from early grace before to grace
+// after each scheduled time
+type timerSchedule struct {
+	*cron.Schedule
+	grace, earlyGrace time.Duration
+}
+
+// parseSchedule parses schedule settings of the timer, nil if it has no schedule
+func (t *Timer) parseSchedule() (*timerSchedule, error) {
+	if t.Schedule == nil {
+		switch {
+		case t.Timezone != nil:
+			return nil, &AttrError{Attr: "timezone", Err: errSetWithoutSchedule}
+		case t.Grace != nil:
+			return nil, &AttrError{Attr: "grace", Err: errSetWithoutSchedule}
+		case t.EarlyGrace != nil:
+			return nil, &AttrError{Attr: "early_grace", Err: errSetWithoutSchedule}
+		}
+		return nil, nil
+	}
+
+	loc, err := time.LoadLocation(StrOrDefault(t.Timezone, "UTC"))
+	if err != nil {
+		return nil, &AttrError{Attr: "timezone", Err: err}
+	}
+	schedule, err := cron.Parse(*t.Schedule, loc)
+	if err == nil {
+		err = schedule.Validate()
+	}
+	if err != nil {
+		return nil, &AttrError{Attr: "schedule", Err: err}
+	}
+
+	grace, err := DurationOrDefault(t.Grace, time.Hour)
+	if err != nil {
+		return nil, &AttrError{Attr: "grace", Err: err}
+	}
+	earlyGrace, err := DurationOrDefault(t.EarlyGrace, grace)
+	if err != nil {
+		return nil, &AttrError{Attr: "early_grace", Err: err}
+	}
+	if grace < 0 || earlyGrace < 0 {
+		return nil, &AttrError{Attr: "grace", Err: errNegativeGrace}
+	}
+
+	return &timerSchedule{Schedule: schedule, grace: grace, earlyGrace: earlyGrace}, nil
+}
+
+// upcoming returns the first scheduled time whose window hasn't ended yet
+func (s *timerSchedule) upcoming(now time.Time) time.Time {
+	return s.Next(now.Add(-s.grace - time.Nanosecond))
+}
+
+// await arms the timer to fire when the window of the scheduled time ends; must be called
+// with the lock held
+func (t *Timer) await(st *timerState, scheduled time.Time, now time.Time) {
+	st.expected = scheduled
+	st.missed = time.Time{}
+	st.repeating = false
+	st.repeats = 0
+	st.interval = ZeroDuration
+	if scheduled.IsZero() {
+		t.arm(st, ZeroDuration, now)
+		return
+	}
+	st.interval = scheduled.Add(t.schedule.grace).Sub(now)
+	t.arm(st, st.interval, now)
+}
+
+// checkIn handles reset of the timer with a schedule. Check-in within the window of the
+// scheduled time is a regular reset, making the timer await the next one. Check-in after
+// the window of the awaited time has ended, or after the timeout of the missed time, is late;
+// it's counted for that time, and the timer awaits the upcoming one. Check-in before the window of the awaited time is early and
+// doesn't change the timer. Duration of the finished run, if known, is reported in the event.
+// Must be called with the lock held.
+func (t *Timer) checkIn(key string, duration cty.Value, now time.Time) []timerEvent {
+	st := t.state(key)
+	st.lastReset = now
+	st.lastSeen = now
+	if st.paused {
+		return nil
+	}
+
+	upcoming := t.schedule.upcoming(now)
+	switch {
+	case upcoming.IsZero():
+		return nil
+
+	case !now.Before(upcoming.Add(-t.schedule.earlyGrace)):
+		t.await(st, t.schedule.Next(upcoming), now)
+		return t.timedEvent(st, "reset", t.onResetCh, false, duration)
+
+	case st.expected.IsZero():
+		// First check-in of the key
+		t.await(st, upcoming, now)
+		return t.timedEvent(st, "reset", t.onResetCh, false, duration)
+
+	case st.expected.Before(upcoming) || !st.missed.IsZero():
+		if !st.missed.IsZero() {
+			st.expected = st.missed
+		}
+		events := t.timedEvent(st, "late", t.onLateCh, false, duration)
+		t.await(st, upcoming, now)
+		return events
+
+	default:
+		return t.timedEvent(st, "early", t.onEarlyCh, false, duration)
+	}
+}
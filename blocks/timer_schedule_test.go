@@ -0,0 +1,102 @@
+package blocks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dbolotin/deadmanswitch/comm"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// newScheduledTimer creates a timer with the schedule, ready for its state to be driven by
+// calling its methods directly
+func newScheduledTimer(t *testing.T, schedule, grace string) *Timer {
+	// Missing key, as decoded from the config
+	key := hcl.StaticExpr(cty.NullVal(cty.DynamicPseudoType), hcl.Range{})
+	timer := &Timer{Schedule: &schedule, Grace: &grace, Key: key}
+	timer.Id = "test"
+	s, err := timer.parseSchedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer.schedule = s
+	timer.states = make(map[string]*timerState)
+	timer.metrics = &timerMetrics{block: timer.Id, limit: 10, labelled: make(map[string]bool)}
+	events := make(chan comm.Msg)
+	timer.onResetCh, timer.onTimeoutCh, timer.onLateCh, timer.onEarlyCh = events, events, events, events
+	return timer
+}
+
+// checkEvent checks that the only event is the expected one, for the given scheduled time
+func checkEvent(t *testing.T, events []timerEvent, event string, scheduled time.Time) {
+	t.Helper()
+	if len(events) != 1 {
+		t.Fatalf("got %d events, expected %s", len(events), event)
+	}
+	value := events[0].msg.Value()
+	if got := value.GetAttr("event"); !got.RawEquals(cty.StringVal(event)) {
+		t.Errorf("got event %s, expected %s", got.GoString(), event)
+	}
+	expected := cty.StringVal(scheduled.Format(time.RFC3339))
+	if got := value.GetAttr("scheduled"); !got.RawEquals(expected) {
+		t.Errorf("%s: got scheduled time %s, expected %s", event, got.GoString(), expected.GoString())
+	}
+}
+
+func TestTimerScheduleMissedWindows(t *testing.T) {
+	timer := newScheduledTimer(t, "0 * * * *", "5m")
+	defer timer.stopTimers()
+	grace := 5 * time.Minute
+
+	// Times are in the future, so the timers armed meanwhile don't fire during the test
+	t1 := time.Now().UTC().Truncate(time.Hour).Add(2 * time.Hour)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+
+	checkEvent(t, timer.checkIn("", noDuration, t1.Add(-time.Hour)), "reset", t1)
+	st := timer.state("")
+
+	// The first missed window
+	checkEvent(t, timer.expire(st, false, t1.Add(grace)), "timeout", t1)
+	if !st.expected.Equal(t2) || !st.deadline.Equal(t2.Add(grace)) {
+		t.Fatalf("after the first timeout, awaiting %s until %s, expected %s until %s",
+			st.expected, st.deadline, t2, t2.Add(grace))
+	}
+
+	// The second missed window is reported as well
+	checkEvent(t, timer.expire(st, false, t2.Add(grace)), "timeout", t2)
+	if !st.expected.Equal(t3) || !st.deadline.Equal(t3.Add(grace)) {
+		t.Fatalf("after the second timeout, awaiting %s until %s, expected %s until %s",
+			st.expected, st.deadline, t3, t3.Add(grace))
+	}
+
+	// Check-in after the timeout is late for the missed time, and the timer goes on awaiting
+	// the following one
+	checkEvent(t, timer.checkIn("", noDuration, t2.Add(10*time.Minute)), "late", t2)
+	if !st.expected.Equal(t3) || !st.deadline.Equal(t3.Add(grace)) {
+		t.Fatalf("after the late check-in, awaiting %s until %s, expected %s until %s",
+			st.expected, st.deadline, t3, t3.Add(grace))
+	}
+
+	// Check-in within the window is a regular one
+	checkEvent(t, timer.checkIn("", noDuration, t3), "reset", t3.Add(time.Hour))
+}
+
+func TestTimerScheduleRepeatsAfterMissedWindow(t *testing.T) {
+	timer := newScheduledTimer(t, "0 * * * *", "5m")
+	defer timer.stopTimers()
+	timer.repeatAfter = 10 * time.Minute
+	timer.BackoffFactor = 1
+	timer.onRepeatCh = timer.onTimeoutCh
+
+	t1 := time.Now().UTC().Truncate(time.Hour).Add(2 * time.Hour)
+	timer.checkIn("", noDuration, t1.Add(-time.Hour))
+	st := timer.state("")
+
+	checkEvent(t, timer.expire(st, false, t1.Add(5*time.Minute)), "timeout", t1)
+	checkEvent(t, timer.expire(st, false, t1.Add(15*time.Minute)), "repeat", t1)
+	if !st.deadline.Equal(t1.Add(25 * time.Minute)) {
+		t.Fatalf("next repeat at %s, expected %s", st.deadline, t1.Add(25*time.Minute))
+	}
+}
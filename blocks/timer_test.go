@@ -0,0 +1,59 @@
+package blocks
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dbolotin/deadmanswitch/bctx"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestTimerSavesChangesAfterStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	store, err := bctx.OpenStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := bctx.NewCtx(nil)
+	env.SetStateStore(store)
+
+	timer := &Timer{Key: hcl.StaticExpr(cty.NullVal(cty.DynamicPseudoType), hcl.Range{})}
+	timer.Id = "test"
+	timer.GetValue(env)
+	if err := timer.Start(env); err != nil {
+		t.Fatal(err)
+	}
+	if err := timer.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Admin API may still control the timer being replaced
+	if _, err := timer.Control(TimerReset, "", TimerControl{Timeout: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	defer timer.stopTimers()
+
+	reopened, err := bctx.OpenStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved savedTimer
+	found, err := reopened.Load(timer.Id, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || saved.Keys[""].Timeout != time.Hour {
+		t.Fatalf("reset after stop was not saved, got %+v", saved)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dbolotin/deadmanswitch/blocks"
+	"github.com/dbolotin/deadmanswitch/config"
+	"github.com/gorilla/mux"
+)
+
+// Time given to requests of the admin API to complete when it's closed
+const adminStopTimeout = 5 * time.Second
+
+// adminServer serves HTTP API to inspect and control timers of the running graph
+type adminServer struct {
+	cfg config.AdminConfig
+	srv *http.Server
+}
+
+type timerInfo struct {
+	Block string               `json:"block"`
+	Keyed bool                 `json:"keyed"`
+	Keys  []blocks.TimerStatus `json:"keys"`
+}
+
+// applyAdmin starts, restarts or stops the admin API according to the configuration
+func (r *runtime) applyAdmin(cfg *config.AdminConfig) error {
+	if r.admin != nil && cfg != nil && sameAdminConfig(r.admin.cfg, *cfg) {
+		return nil
+	}
+
+	r.closeAdmin()
+	if cfg == nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return err
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/timers", r.listTimers).Methods(http.MethodGet)
+	router.HandleFunc("/timers/{block}", r.getTimer).Methods(http.MethodGet)
+	router.HandleFunc("/timers/{block}/{action}", r.controlTimer).Methods(http.MethodPost)
+
+	var handler http.Handler = router
+	if cfg.Token != nil {
+		handler = requireToken(*cfg.Token, router)
+	}
+
+	srv := &http.Server{Handler: handler}
+	go func() {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			log.Println("Admin API error:", err)
+		}
+	}()
+	r.admin = &adminServer{cfg: *cfg, srv: srv}
+	log.Println("Admin API listening on", cfg.Address)
+
+	return nil
+}
+
+func (r *runtime) closeAdmin() {
+	if r.admin == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminStopTimeout)
+	defer cancel()
+	_ = r.admin.srv.Shutdown(ctx)
+	r.admin = nil
+}
+
+func sameAdminConfig(a, b config.AdminConfig) bool {
+	if a.Address != b.Address || (a.Token == nil) != (b.Token == nil) {
+		return false
+	}
+	return a.Token == nil || *a.Token == *b.Token
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// timers returns timer blocks of the running graph, in config order
+func (r *runtime) timers() []*blocks.Timer {
+	r.graphLock.RLock()
+	defer r.graphLock.RUnlock()
+
+	var result []*blocks.Timer
+	for _, e := range r.graph.Entries {
+		if t, ok := e.Block.(*blocks.Timer); ok {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func (r *runtime) findTimer(id string) *blocks.Timer {
+	for _, t := range r.timers() {
+		if t.GetId() == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func describeTimer(t *blocks.Timer) timerInfo {
+	return timerInfo{Block: t.GetId(), Keyed: t.Keyed(), Keys: t.Status()}
+}
+
+func (r *runtime) listTimers(w http.ResponseWriter, _ *http.Request) {
+	result := []timerInfo{}
+	for _, t := range r.timers() {
+		result = append(result, describeTimer(t))
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"timers": result})
+}
+
+func (r *runtime) getTimer(w http.ResponseWriter, req *http.Request) {
+	t := r.findTimer(mux.Vars(req)["block"])
+	if t == nil {
+		writeAdminError(w, http.StatusNotFound, errors.New("unknown timer block"))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, describeTimer(t))
+}
+
+// controlTimer takes the action on the key given in "key" query parameter. Reset accepts
+// "timeout" duration, snooze requires either "until" time (RFC 3339) or "for" duration.
+func (r *runtime) controlTimer(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	t := r.findTimer(vars["block"])
+	if t == nil {
+		writeAdminError(w, http.StatusNotFound, errors.New("unknown timer block"))
+		return
+	}
+
+	query := req.URL.Query()
+	_, hasKey := query["key"]
+	if t.Keyed() != hasKey {
+		if t.Keyed() {
+			writeAdminError(w, http.StatusBadRequest, errors.New("key is required for keyed timer"))
+		} else {
+			writeAdminError(w, http.StatusBadRequest, errors.New("timer is not keyed"))
+		}
+		return
+	}
+
+	var c blocks.TimerControl
+	var err error
+	if s := query.Get("timeout"); s != "" {
+		if c.Timeout, err = time.ParseDuration(s); err != nil || c.Timeout <= 0 {
+			writeAdminError(w, http.StatusBadRequest, errors.New("invalid timeout"))
+			return
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		if c.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.New("invalid until time, RFC 3339 expected"))
+			return
+		}
+	}
+	if s := query.Get("for"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.New("invalid snooze duration"))
+			return
+		}
+		c.Until = time.Now().Add(d)
+	}
+
+	status, err := t.Control(vars["action"], query.Get("key"), c)
+	switch err {
+	case nil:
+		target := t.GetId()
+		if hasKey {
+			target += " key " + query.Get("key")
+		}
+		log.Printf("Admin API: %s of %s", vars["action"], target)
+		writeAdminJSON(w, http.StatusOK, status)
+	case blocks.ErrUnknownTimerKey, blocks.ErrUnknownTimerAction:
+		writeAdminError(w, http.StatusNotFound, err)
+	case blocks.ErrTimerPaused, blocks.ErrTimerNotPaused:
+		writeAdminError(w, http.StatusConflict, err)
+	case blocks.ErrTimerNotRunning:
+		writeAdminError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeAdminError(w, http.StatusBadRequest, err)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
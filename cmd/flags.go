@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// varFlags collects values of config variables given on the command line
+type varFlags struct {
+	values map[string]string
+	files  []string
+}
+
+// addVarFlags registers -var and -var-file options in the flag set
+func addVarFlags(flags *flag.FlagSet) *varFlags {
+	v := &varFlags{values: make(map[string]string)}
+	flags.Var(varValueFlag{v}, "var", "set a variable in the config, `name=value`; can be repeated")
+	flags.Var(varFileFlag{v}, "var-file", "set variables in the config from a `file` of \"name = value\" lines; can be repeated")
+	return v
+}
+
+type varValueFlag struct{ v *varFlags }
+
+func (f varValueFlag) String() string {
+	return ""
+}
+
+func (f varValueFlag) Set(s string) error {
+	pair := strings.SplitN(s, "=", 2)
+	if len(pair) != 2 || pair[0] == "" {
+		return fmt.Errorf("variable must be set as name=value")
+	}
+	f.v.values[pair[0]] = pair[1]
+	return nil
+}
+
+type varFileFlag struct{ v *varFlags }
+
+func (f varFileFlag) String() string {
+	return ""
+}
+
+func (f varFileFlag) Set(s string) error {
+	f.v.files = append(f.v.files, s)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dbolotin/deadmanswitch/blocks"
+	"github.com/dbolotin/deadmanswitch/config"
+)
+
+// graph prints the wiring of the blocks as a diagram. Returns exit code.
+func graph(args []string) int {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	vars := addVarFlags(flags)
+	format := flags.String("format", "dot", "diagram format: dot or mermaid")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: hookblock graph [options] <file, directory or glob>...")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		fmt.Println("Wrong number of arguments.")
+		flags.Usage()
+		return 1
+	}
+
+	var render func(w io.Writer, g *config.Graph)
+	switch *format {
+	case "dot":
+		render = renderDot
+	case "mermaid":
+		render = renderMermaid
+	default:
+		fmt.Printf("Unknown diagram format: %s\n", *format)
+		return 1
+	}
+
+	// Keeping stdout clean for the diagram
+	r := &runtime{
+		args:        flags.Args(),
+		vars:        vars,
+		env:         newEnv(),
+		graph:       &config.Graph{},
+		diagnostics: os.Stderr,
+	}
+	g, _ := r.load()
+	if g == nil {
+		return 1
+	}
+
+	render(os.Stdout, g)
+	return 0
+}
+
+// Renders Graphviz DOT diagram
+func renderDot(w io.Writer, g *config.Graph) {
+	quote := func(s string) string {
+		s = strings.ReplaceAll(s, "\\", "\\\\")
+		s = strings.ReplaceAll(s, "\n", "\\n")
+		return "\"" + strings.ReplaceAll(s, "\"", "\\\"") + "\""
+	}
+
+	_, _ = fmt.Fprintln(w, "digraph hookblock {")
+	_, _ = fmt.Fprintln(w, "  rankdir=LR;")
+	_, _ = fmt.Fprintln(w, "  node [shape=box];")
+	for _, e := range g.Entries {
+		id := e.Block.GetId()
+		_, _ = fmt.Fprintf(w, "  %s [label=%s];\n", quote(id), quote(id+"\n("+e.Type+")"))
+	}
+	for _, e := range g.Entries {
+		for _, l := range blocks.Links(e.Block) {
+			_, _ = fmt.Fprintf(w, "  %s -> %s [label=%s];\n", quote(e.Block.GetId()), quote(l.Target), quote(l.Attr))
+		}
+	}
+	_, _ = fmt.Fprintln(w, "}")
+}
+
+// Renders Mermaid flowchart
+func renderMermaid(w io.Writer, g *config.Graph) {
+	quote := func(s string) string {
+		return "\"" + strings.ReplaceAll(s, "\"", "#quot;") + "\""
+	}
+
+	// Block ids may contain characters not allowed in Mermaid node ids
+	nodes := make(map[string]string)
+	for i, e := range g.Entries {
+		nodes[e.Block.GetId()] = fmt.Sprintf("n%d", i)
+	}
+
+	_, _ = fmt.Fprintln(w, "flowchart LR")
+	for _, e := range g.Entries {
+		id := e.Block.GetId()
+		_, _ = fmt.Fprintf(w, "  %s[%s]\n", nodes[id], quote(id+"<br/>("+e.Type+")"))
+	}
+	for _, e := range g.Entries {
+		for _, l := range blocks.Links(e.Block) {
+			_, _ = fmt.Fprintf(w, "  %s -->|%s| %s\n", nodes[e.Block.GetId()], quote(l.Attr), nodes[l.Target])
+		}
+	}
+}
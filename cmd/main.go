@@ -1,155 +1,123 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dbolotin/deadmanswitch/bctx"
-	"github.com/dbolotin/deadmanswitch/blocks"
+	"github.com/dbolotin/deadmanswitch/config"
 	"github.com/hashicorp/hcl/v2"
-	"github.com/hashicorp/hcl/v2/gohcl"
-	"github.com/hashicorp/hcl/v2/hclparse"
-	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/zclconf/go-cty/cty"
 )
 
 func main() {
-	// HCL Parser
-	parser := hclparse.NewParser()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "graph":
+			os.Exit(graph(os.Args[2:]))
+		}
+	}
 
-	// Diagnostics writer
-	writer := hcl.NewDiagnosticTextWriter(os.Stdout, parser.Files(), 80, true)
-	allDiag := hcl.Diagnostics{}
+	run()
+}
 
-	if len(os.Args) != 2 {
-		fmt.Println("Wrong number of arguments.")
-		os.Exit(1)
+func run() {
+	vars := addVarFlags(flag.CommandLine)
+	watch := flag.Duration("watch", 0, "check config files for changes with the given interval and reload them automatically")
+	gracePeriod := flag.Duration("grace-period", 30*time.Second, "time given to in-flight messages to be processed on shutdown")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: hookblock [options] <file, directory or glob>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       hookblock validate [options] <file, directory or glob>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       hookblock graph [options] <file, directory or glob>...")
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	// Parsing config file
-	f, diag := parser.ParseHCLFile(os.Args[1])
-	allDiag = allDiag.Extend(diag)
-	if allDiag.HasErrors() {
-		_ = writer.WriteDiagnostics(diag)
+	if flag.NArg() < 1 {
+		fmt.Println("Wrong number of arguments.")
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Creating main context
-	bCtx := bctx.NewCtx(writer)
+	bCtx := newEnv()
 
-	// Setting context variables
-
-	// Environment variables
-	envs := make(map[string]cty.Value)
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		envs[pair[0]] = cty.StringVal(pair[1])
+	// Interpreting the config
+	r := &runtime{
+		args:  flag.Args(),
+		vars:  vars,
+		env:   bCtx,
+		graph: &config.Graph{},
+	}
+	graph, _ := r.load()
+	if graph == nil {
+		os.Exit(1)
 	}
-	bCtx.DefaultVariables["env"] = cty.MapVal(envs)
 
-	// First round of config interpretation
-
-	blockVariables := make(map[string]cty.Value)
-	registry := blocks.BlockRegistry()
-	blocksById := make(map[string]blocks.Block)
-	var blocksByIndex []blocks.Block
-
-	body := f.Body.(*hclsyntax.Body)
-	for _, b := range body.Blocks {
-		rng := b.Range()
-
-		factory := registry[b.Type]
-		if factory == nil {
-			allDiag = allDiag.Append(&hcl.Diagnostic{
-				Severity: hcl.DiagError,
-				Summary:  "Unknown block type",
-				Detail:   fmt.Sprintf("Unknown block: %s", b.Type),
-				Subject:  &b.TypeRange,
-				Context:  &rng,
-			})
-			break
-		}
+	// Starting the process
+	err := r.apply(graph)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-		block := factory()
-		blocksByIndex = append(blocksByIndex, block)
+	log.Println("Initialization complete")
 
-		if len(b.Labels) == 0 {
-			block.SetId(b.Type + "_" + strconv.Itoa(len(blocksByIndex)-1))
-			break
-		}
+	// Reloading configuration on request, until termination
 
-		id := b.Labels[0]
-		block.SetId(id)
-
-		if _, exist := blocksById[id]; exist {
-			allDiag = allDiag.Append(&hcl.Diagnostic{
-				Severity: hcl.DiagError,
-				Summary:  "Duplicate block identifier",
-				Detail:   fmt.Sprintf("Duplicate block identifier: %s", id),
-				Subject:  &b.LabelRanges[0],
-				Context:  &rng,
-			})
-			break
-		}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-		if _, exist := blockVariables[id]; exist {
-			allDiag = allDiag.Append(&hcl.Diagnostic{
-				Severity: hcl.DiagError,
-				Summary:  "Reserved variable name",
-				Detail:   fmt.Sprintf("Reserved variable name: %s", id),
-				Subject:  &b.LabelRanges[0],
-				Context:  &rng,
-			})
-			break
-		}
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
 
-		blocksById[id] = block
-		blockVariables[id] = block.GetValue(bCtx)
+	var changes <-chan struct{} = nil
+	if *watch != 0 {
+		changes = watchFiles(r.watchedPaths, *watch)
 	}
 
-	if allDiag.HasErrors() {
-		_ = writer.WriteDiagnostics(allDiag)
-		os.Exit(1)
-	}
-
-	// Second round of config interpretation
-
-	// Add all default variables to block variables
-	for k, v := range bCtx.DefaultVariables {
-		blockVariables[k] = v
-	}
-	ctx := &hcl.EvalContext{
-		Variables: blockVariables,
-	}
-	for i, b := range body.Blocks {
-		//noinspection GoNilness
-		block := blocksByIndex[i]
-		diag = gohcl.DecodeBody(b.Body, ctx, block)
-		allDiag = allDiag.Extend(diag)
-		if diag.HasErrors() {
-			break
+	//noinspection GoNilness
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading configuration")
+		case <-changes:
+			log.Println("Config files changed, reloading configuration")
+		case sig := <-term:
+			log.Printf("%s received, shutting down", sig)
+			if !r.shutdown(*gracePeriod) {
+				log.Fatalln("Grace period exceeded, some messages may be lost")
+			}
+			log.Println("Shutdown complete")
+			return
 		}
+		r.reload()
 	}
-	if allDiag.HasErrors() {
-		_ = writer.WriteDiagnostics(allDiag)
-		os.Exit(1)
-	}
+}
 
-	// Starting the process
+// newEnv creates main context
+func newEnv() *bctx.BEnv {
+	bCtx := bctx.NewCtx(newDiagnosticWriter(nil))
 
-	for _, block := range blocksByIndex {
-		err := block.Start(bCtx)
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}
+	// Setting context variables
 
-	log.Println("Initialization complete")
+	// Environment variables
+	envs := make(map[string]cty.Value)
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		envs[pair[0]] = cty.StringVal(pair[1])
+	}
+	bCtx.DefaultVariables["env"] = cty.MapVal(envs)
 
-	// Block forever
+	return bCtx
+}
 
-	select {}
+func newDiagnosticWriter(files map[string]*hcl.File) hcl.DiagnosticWriter {
+	return hcl.NewDiagnosticTextWriter(os.Stdout, files, 80, true)
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbolotin/deadmanswitch/bctx"
+	"github.com/dbolotin/deadmanswitch/config"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+)
+
+// Time given to replaced blocks to complete processing of in-flight messages
+const stopTimeout = 15 * time.Second
+
+// runtime holds the currently running block graph
+type runtime struct {
+	args  []string
+	vars  *varFlags
+	env   *bctx.BEnv
+	graph *config.Graph
+	// Guards the graph read by the admin API
+	graphLock sync.RWMutex
+
+	// Source of the graph that was running before the last apply
+	previous *config.Source
+
+	// Destination for config diagnostics, stdout by default
+	diagnostics io.Writer
+
+	// All config files ever loaded, for rendering of runtime diagnostics
+	files map[string]*hcl.File
+
+	// Module directories of the running graph, watched along with the arguments
+	moduleDirs     []string
+	moduleDirsLock sync.Mutex
+
+	// Nil if admin API is disabled
+	admin *adminServer
+}
+
+// load parses, interprets and checks config files, reporting problems to stdout. Returns nil
+// graph if config is invalid.
+func (r *runtime) load() (*config.Graph, hcl.Diagnostics) {
+	// HCL Parser
+	parser := hclparse.NewParser()
+
+	// Diagnostics writer
+	out := r.diagnostics
+	if out == nil {
+		out = os.Stdout
+	}
+	writer := hcl.NewDiagnosticTextWriter(out, parser.Files(), 80, true)
+
+	graph, diag := r.loadWith(parser)
+	if len(diag) != 0 {
+		_ = writer.WriteDiagnostics(diag)
+	}
+	if diag.HasErrors() {
+		return nil, diag
+	}
+
+	return graph, diag
+}
+
+func (r *runtime) loadWith(parser *hclparse.Parser) (*config.Graph, hcl.Diagnostics) {
+	// Resolving config files
+	paths, err := config.ResolvePaths(r.args)
+	if err != nil {
+		return nil, hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid config path",
+			Detail:   err.Error(),
+		}}
+	}
+
+	// Parsing config files
+	src, diag := config.ParseFiles(parser, paths)
+	if diag.HasErrors() {
+		return nil, diag
+	}
+
+	// Parsing variable values
+	src.Vars = r.vars.values
+	src.VarAttrs, diag = config.ParseVarFiles(parser, r.vars.files)
+	if diag.HasErrors() {
+		return nil, diag
+	}
+
+	// Interpreting the config
+	graph, diag := config.Load(r.env, src)
+	if diag.HasErrors() {
+		return nil, diag
+	}
+
+	return graph, diag.Extend(config.Check(graph))
+}
+
+// reload re-reads the config and applies it to the running graph. Invalid config is
+// rejected, leaving the running graph intact.
+func (r *runtime) reload() {
+	next, _ := r.load()
+	if next == nil {
+		log.Println("Configuration rejected, keeping the running one")
+		return
+	}
+
+	err := r.apply(next)
+	if err == nil {
+		log.Println("Configuration reloaded")
+		return
+	}
+
+	log.Println(err)
+	log.Println("Restoring previous configuration")
+
+	// Source of the previous graph was valid, so interpreting it once again gives fresh
+	// instances of the blocks that were replaced
+	previous, diag := config.Load(r.env, r.previous)
+	if diag.HasErrors() {
+		r.env.WriteDiagnostics(diag)
+		log.Fatalln("Can't restore previous configuration")
+	}
+	err = r.apply(previous)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// apply makes the next graph the running one. Blocks with unchanged definitions are
+// carried over together with their internal state (e.g. armed timers), other blocks of
+// the running graph are stopped and blocks of the next graph are started in their place.
+func (r *runtime) apply(next *config.Graph) error {
+	store, err := r.openStateStore(next.State)
+	if err != nil {
+		return fmt.Errorf("error opening state file: %s", err)
+	}
+
+	running := make(map[string]*config.Entry)
+	for _, e := range r.graph.Entries {
+		running[e.Block.GetId()] = e
+	}
+
+	var toStart []*config.Entry
+	kept := make(map[string]bool)
+	for _, e := range next.Entries {
+		id := e.Block.GetId()
+		if prev, ok := running[id]; ok && prev.Fingerprint == e.Fingerprint {
+			e.Block = prev.Block
+			e.Env = prev.Env
+			kept[id] = true
+		} else {
+			toStart = append(toStart, e)
+		}
+	}
+
+	var toStop []*config.Entry
+	for _, e := range r.graph.Entries {
+		if !kept[e.Block.GetId()] {
+			toStop = append(toStop, e)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	stopped := stopBlocks(ctx, toStop)
+	cancel()
+
+	// From this point next graph is the running one, even if some of its blocks fail to start
+	if r.graph.Source != nil {
+		r.previous = r.graph.Source
+	}
+	r.graphLock.Lock()
+	r.graph = next
+	r.graphLock.Unlock()
+	r.updateFiles(next.Source)
+	r.moduleDirsLock.Lock()
+	r.moduleDirs = next.Source.ModuleDirs()
+	r.moduleDirsLock.Unlock()
+
+	ids := make(map[string]bool)
+	for _, e := range next.Entries {
+		ids[e.Block.GetId()] = true
+	}
+	r.env.RetainChannels(ids)
+
+	if store != r.env.StateStore() && store != nil {
+		log.Println("Persisting state to", store.Path())
+	}
+	r.env.SetStateStore(store)
+	if store != nil {
+		if err := store.Retain(ids); err != nil {
+			log.Println("Error writing state file:", err)
+		}
+	}
+
+	var started []string
+	for _, e := range toStart {
+		err := e.Block.Start(e.Env)
+		if err != nil {
+			return fmt.Errorf("error starting block %s: %s", e.Block.GetId(), err)
+		}
+		started = append(started, e.Block.GetId())
+	}
+
+	if err := r.applyAdmin(next.Admin); err != nil {
+		return fmt.Errorf("error starting admin API: %s", err)
+	}
+
+	if r.previous != nil {
+		log.Printf("Blocks stopped: [%s]; started: [%s]; unchanged: %d",
+			strings.Join(stopped, ", "), strings.Join(started, ", "), len(kept))
+	}
+
+	return nil
+}
+
+// openStateStore returns the state store configured for the graph, reusing the current one if
+// the state file didn't change
+func (r *runtime) openStateStore(cfg *config.StateConfig) (*bctx.StateStore, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if current := r.env.StateStore(); current != nil && current.Path() == cfg.Path {
+		return current, nil
+	}
+	return bctx.OpenStateStore(cfg.Path)
+}
+
+// updateFiles makes runtime diagnostics aware of the newly loaded files
+func (r *runtime) updateFiles(src *config.Source) {
+	files := make(map[string]*hcl.File)
+	for k, v := range r.files {
+		files[k] = v
+	}
+	for k, v := range src.Files {
+		files[k] = v
+	}
+	r.files = files
+	r.env.SetDiagnosticWriter(newDiagnosticWriter(files))
+}
+
+// watchedPaths returns arguments, variable files and module directories of the running graph
+func (r *runtime) watchedPaths() []string {
+	r.moduleDirsLock.Lock()
+	defer r.moduleDirsLock.Unlock()
+	result := append(append([]string{}, r.args...), r.vars.files...)
+	return append(result, r.moduleDirs...)
+}
+
+// watchFiles periodically checks config files for modifications. Files added to or removed
+// from config directories are also detected.
+func watchFiles(paths func() []string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{})
+
+	go func() {
+		last := filesState(paths())
+		for range time.Tick(interval) {
+			current := filesState(paths())
+			if current != last {
+				last = current
+				changes <- struct{}{}
+			}
+		}
+	}()
+
+	return changes
+}
+
+// filesState summarizes paths, sizes and modification times of config files
+func filesState(args []string) string {
+	paths, err := config.ResolvePaths(args)
+	if err != nil {
+		return err.Error()
+	}
+
+	var sb strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			sb.WriteString(err.Error())
+			continue
+		}
+		_, _ = fmt.Fprintf(&sb, "%s:%d:%d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return sb.String()
+}
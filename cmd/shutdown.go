@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/dbolotin/deadmanswitch/blocks"
+	"github.com/dbolotin/deadmanswitch/config"
+)
+
+// stopBlocks stops the blocks, upstream ones first, so messages already accepted by the
+// upstream blocks can still be processed downstream. All blocks share the context deadline.
+// Returns ids of the stopped blocks.
+func stopBlocks(ctx context.Context, entries []*config.Entry) []string {
+	var stopped []string
+	for _, e := range upstreamFirst(entries) {
+		id := e.Block.GetId()
+		err := e.Block.Stop(ctx)
+		if err != nil {
+			log.Println("Error stopping block", id, ":", err)
+		}
+		stopped = append(stopped, id)
+	}
+	return stopped
+}
+
+// upstreamFirst orders entries so that every block goes after the blocks sending messages
+// to it. Blocks forming a cycle keep their config order.
+func upstreamFirst(entries []*config.Entry) []*config.Entry {
+	byId := make(map[string]*config.Entry)
+	for _, e := range entries {
+		byId[e.Block.GetId()] = e
+	}
+
+	// Number of senders of each block, among the given ones
+	senders := make(map[string]int)
+	for _, e := range entries {
+		for _, l := range blocks.Links(e.Block) {
+			if _, ok := byId[l.Target]; ok && l.Target != e.Block.GetId() {
+				senders[l.Target]++
+			}
+		}
+	}
+
+	var result []*config.Entry
+	done := make(map[string]bool)
+	for len(result) < len(entries) {
+		progress := false
+		for _, e := range entries {
+			id := e.Block.GetId()
+			if done[id] || senders[id] > 0 {
+				continue
+			}
+			done[id] = true
+			progress = true
+			result = append(result, e)
+			for _, l := range blocks.Links(e.Block) {
+				if _, ok := byId[l.Target]; ok && l.Target != id {
+					senders[l.Target]--
+				}
+			}
+		}
+
+		if !progress {
+			// Cycle; releasing its first block
+			for _, e := range entries {
+				if id := e.Block.GetId(); !done[id] {
+					senders[id] = 0
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// shutdown stops all blocks of the running graph, giving them the grace period to complete
+// processing of in-flight messages. Returns false if the grace period was exceeded.
+func (r *runtime) shutdown(gracePeriod time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	r.closeAdmin()
+	stopBlocks(ctx, r.graph.Entries)
+	return ctx.Err() == nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dbolotin/deadmanswitch/config"
+)
+
+// validate interprets the config without starting any of the blocks. Returns exit code.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	vars := addVarFlags(flags)
+	strict := flags.Bool("strict", false, "treat warnings as errors")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: hookblock validate [options] <file, directory or glob>...")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		fmt.Println("Wrong number of arguments.")
+		flags.Usage()
+		return 1
+	}
+
+	r := &runtime{
+		args:  flags.Args(),
+		vars:  vars,
+		env:   newEnv(),
+		graph: &config.Graph{},
+	}
+	graph, diag := r.load()
+	if graph == nil || (*strict && len(diag) != 0) {
+		fmt.Fprintln(os.Stderr, "Configuration is invalid.")
+		return 1
+	}
+
+	files := len(graph.Source.Paths)
+	for _, m := range graph.Source.Modules {
+		files += len(m.Paths)
+	}
+	fmt.Printf("Configuration is valid: %d blocks in %d files.\n", len(graph.Entries), files)
+	return 0
+}
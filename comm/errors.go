@@ -0,0 +1,144 @@
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ErrorKind classifies failures, e.g. to choose HTTP status of the reply to the original request
+type ErrorKind string
+
+const (
+	// Expression can't be evaluated for the message
+	ErrorEvaluation ErrorKind = "evaluation"
+	// Remote service is unreachable or its response can't be read
+	ErrorTransport ErrorKind = "transport"
+	// Processing took too long
+	ErrorTimeout ErrorKind = "timeout"
+	// Remote service replied with unexpected status
+	ErrorUpstreamStatus ErrorKind = "upstream_status"
+	// Message not accepted by a block, e.g. because its queue is full
+	ErrorRejected ErrorKind = "rejected"
+	// Any other failure
+	ErrorInternal ErrorKind = "internal"
+)
+
+// Error describes failure of message processing to the sender of the message
+type Error struct {
+	Kind    ErrorKind `json:"kind"`
+	Message string    `json:"message"`
+	// Id of the failed block
+	Block string `json:"block,omitempty"`
+	// Failures of downstream blocks that caused this one
+	Causes []*Error `json:"causes,omitempty"`
+}
+
+func NewError(kind ErrorKind, err error) *Error {
+	return &Error{Kind: kind, Message: err.Error()}
+}
+
+func Errorf(kind ErrorKind, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+	if e.Block != "" {
+		sb.WriteString(e.Block)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(e.Message)
+	for i, c := range e.Causes {
+		if i == 0 {
+			sb.WriteString("; caused by: ")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(c.Error())
+	}
+	return sb.String()
+}
+
+// AsError converts an error returned by a block into Error attributed to that block.
+// Configuration diagnostics are treated as evaluation errors, unknown errors as internal ones.
+func AsError(blockId string, err error) *Error {
+	var result *Error
+	var diag hcl.Diagnostics
+	var diagnostic *hcl.Diagnostic
+	switch {
+	case errors.As(err, &result):
+	case errors.As(err, &diag), errors.As(err, &diagnostic):
+		result = NewError(ErrorEvaluation, err)
+	default:
+		result = NewError(ErrorInternal, err)
+	}
+	if result.Block == "" {
+		result.Block = blockId
+	}
+	return result
+}
+
+// Value renders the error as the value of "err" attribute of the error reply
+func (e *Error) Value() cty.Value {
+	causes := make([]cty.Value, len(e.Causes))
+	for i, c := range e.Causes {
+		causes[i] = c.Value()
+	}
+	return cty.ObjectVal(map[string]cty.Value{
+		"kind":    cty.StringVal(string(e.Kind)),
+		"message": cty.StringVal(e.Message),
+		"block":   cty.StringVal(e.Block),
+		"causes":  cty.TupleVal(causes),
+	})
+}
+
+// ErrorReply creates reply value reporting the error
+func ErrorReply(err *Error) cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{"err": err.Value()})
+}
+
+// ErrorFromReply extracts the error from the reply, returns nil if it is not an error reply
+func ErrorFromReply(rep cty.Value) *Error {
+	if !IsErrorReply(rep) {
+		return nil
+	}
+	return errorFromValue(rep.GetAttr("err"))
+}
+
+func errorFromValue(v cty.Value) *Error {
+	result := &Error{Kind: ErrorInternal}
+	if v.IsNull() || !v.IsKnown() || !v.Type().IsObjectType() {
+		return result
+	}
+
+	str := func(name string) string {
+		if !v.Type().HasAttribute(name) {
+			return ""
+		}
+		s := v.GetAttr(name)
+		if s.Type() != cty.String || s.IsNull() || !s.IsKnown() {
+			return ""
+		}
+		return s.AsString()
+	}
+	if kind := str("kind"); kind != "" {
+		result.Kind = ErrorKind(kind)
+	}
+	result.Message = str("message")
+	result.Block = str("block")
+
+	if v.Type().HasAttribute("causes") {
+		causes := v.GetAttr("causes")
+		if causes.CanIterateElements() && causes.IsKnown() && !causes.IsNull() {
+			for it := causes.ElementIterator(); it.Next(); {
+				_, c := it.Element()
+				result.Causes = append(result.Causes, errorFromValue(c))
+			}
+		}
+	}
+	return result
+}
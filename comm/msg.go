@@ -4,7 +4,6 @@ import (
 	"context"
 	"sync/atomic"
 
-	"github.com/dbolotin/deadmanswitch/ctyutil"
 	"github.com/zclconf/go-cty/cty"
 )
 
@@ -72,14 +71,12 @@ func (m *Msg) Reply(val cty.Value) {
 	}
 }
 
-var ErrorReply = cty.ObjectVal(map[string]cty.Value{"err": ctyutil.StrNullVal})
-
 func IsErrorReply(rep cty.Value) bool {
 	return (rep.Type().IsObjectType() || rep.Type().IsMapType()) && rep.Type().HasAttribute("err")
 }
 
-func (m *Msg) ReplyWithError() {
-	m.Reply(ErrorReply)
+func (m *Msg) ReplyWithError(err *Error) {
+	m.Reply(ErrorReply(err))
 }
 
 func (m *Msg) Close() {
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/dbolotin/deadmanswitch/blocks"
+	"github.com/hashicorp/hcl/v2"
+)
+
+// Check performs static checks of the interpreted config, that don't require any of
+// the blocks to be started
+func Check(graph *Graph) hcl.Diagnostics {
+	allDiag := hcl.Diagnostics{}
+
+	// Checking block-specific settings
+	allDiag = allDiag.Extend(validateBlocks(graph.Entries))
+
+	// Detecting blocks that never receive messages
+	referenced := make(map[string]bool)
+	for _, e := range graph.Entries {
+		for _, t := range references(e.Def.Body) {
+			for _, id := range e.scope.resolve(t) {
+				if id != e.Block.GetId() {
+					referenced[id] = true
+				}
+			}
+		}
+	}
+	for _, s := range graph.scopes {
+		for _, call := range s.calls {
+			for _, t := range references(call.Body) {
+				for _, id := range s.resolve(t) {
+					referenced[id] = true
+				}
+			}
+		}
+	}
+	for _, e := range graph.Entries {
+		if _, ok := e.Block.(blocks.InputBlock); !ok || referenced[e.Block.GetId()] {
+			continue
+		}
+		rng := e.Def.Range()
+		subject := e.Def.DefRange()
+		allDiag = allDiag.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Unused block",
+			Detail:   fmt.Sprintf("No block sends messages to %s", e.Block.GetId()),
+			Subject:  &subject,
+			Context:  &rng,
+		})
+	}
+
+	return allDiag
+}
+
+// validateBlocks checks block-specific settings of the decoded blocks
+func validateBlocks(entries []*Entry) hcl.Diagnostics {
+	allDiag := hcl.Diagnostics{}
+	for _, e := range entries {
+		validator, ok := e.Block.(blocks.Validator)
+		if !ok || !e.decoded {
+			continue
+		}
+		for _, err := range validator.Validate() {
+			rng := e.Def.Range()
+			subject := e.Def.DefRange()
+			if attrErr, ok := err.(*blocks.AttrError); ok {
+				subject = attrRange(e.Def, attrErr.Attr)
+			}
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid block configuration",
+				Detail:   fmt.Sprintf("Invalid configuration of %s: %s", e.Block.GetId(), err),
+				Subject:  &subject,
+				Context:  &rng,
+			})
+		}
+	}
+	return allDiag
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// Extension of configuration files picked up from directories
+const FileExtension = ".hcl"
+
+// ResolvePaths expands command line arguments into the list of configuration files.
+// Each argument may be a path to a file, a path to a directory (all *.hcl files
+// directly inside it are used) or a glob pattern. Files are returned in a stable order
+// without duplicates.
+func ResolvePaths(args []string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+
+	add := func(path string) {
+		path = filepath.Clean(path)
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		result = append(result, path)
+	}
+
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("malformed path pattern \"%s\": %s", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no configuration files found at \"%s\"", arg)
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+
+			files, err := ioutil.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				if f.IsDir() || filepath.Ext(f.Name()) != FileExtension {
+					continue
+				}
+				add(filepath.Join(match, f.Name()))
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no configuration files found")
+	}
+
+	return result, nil
+}
+
+// Source is a set of parsed configuration files together with values of variables
+type Source struct {
+	Paths  []string
+	Files  map[string]*hcl.File
+	Blocks []*hclsyntax.Block
+
+	// Parsed sources of all modules used by the config, by module directory. Set for the
+	// root source only.
+	Modules map[string]*Source
+
+	// Values of variables set on the command line, by name
+	Vars map[string]string
+	// Values of variables set in variable files
+	VarAttrs hcl.Attributes
+}
+
+// ModuleDirs returns directories of all modules used by the config
+func (s *Source) ModuleDirs() []string {
+	var result []string
+	for dir := range s.Modules {
+		result = append(result, dir)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Bytes returns source code of the given range
+func (s *Source) Bytes(rng hcl.Range) []byte {
+	f := s.Files[rng.Filename]
+	if f == nil || rng.End.Byte > len(f.Bytes) {
+		return nil
+	}
+	return f.Bytes[rng.Start.Byte:rng.End.Byte]
+}
+
+// ParseFiles parses all the files and collects their top-level blocks in order. Files of
+// the modules referenced from the config are parsed as well.
+func ParseFiles(parser *hclparse.Parser, paths []string) (*Source, hcl.Diagnostics) {
+	modules := make(map[string]*Source)
+	src, diag := parseSource(parser, paths, modules, nil)
+	src.Modules = modules
+	return src, diag
+}
+
+func parseSource(parser *hclparse.Parser, paths []string, modules map[string]*Source, stack []string) (*Source, hcl.Diagnostics) {
+	src := &Source{
+		Paths: paths,
+		Files: parser.Files(),
+	}
+	allDiag := hcl.Diagnostics{}
+
+	for _, path := range paths {
+		f, diag := parser.ParseHCLFile(path)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+
+		body := f.Body.(*hclsyntax.Body)
+		src.Blocks = append(src.Blocks, body.Blocks...)
+	}
+
+	for _, b := range src.Blocks {
+		if b.Type != moduleBlockType {
+			continue
+		}
+
+		dir, diag := moduleDir(b)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+
+		recursive := false
+		for _, d := range stack {
+			recursive = recursive || d == dir
+		}
+		if recursive {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Recursive module",
+				Detail:   fmt.Sprintf("Module %s instantiates itself", dir),
+				Subject:  b.DefRange().Ptr(),
+			})
+			continue
+		}
+
+		if _, parsed := modules[dir]; parsed {
+			continue
+		}
+
+		modulePaths, err := ResolvePaths([]string{dir})
+		if err != nil {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid module source",
+				Detail:   err.Error(),
+				Subject:  b.Body.Attributes[moduleSourceAttr].Expr.Range().Ptr(),
+			})
+			continue
+		}
+
+		moduleSrc, diag := parseSource(parser, modulePaths, modules, append(stack, dir))
+		allDiag = allDiag.Extend(diag)
+		modules[dir] = moduleSrc
+	}
+
+	return src, allDiag
+}
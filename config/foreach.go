@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// Meta-argument generating an instance of the block for each element of a collection
+const forEachAttr = "for_each"
+
+// Variable with key and value of the element the block instance is generated for
+const eachVariable = "each"
+
+// Attributes interpreted by the loader itself rather than by the blocks
+var metaAttrs = map[string]bool{
+	forEachAttr:     true,
+	concurrencyAttr: true,
+	queueSizeAttr:   true,
+	overflowAttr:    true,
+}
+
+// Element of the for_each collection
+type instance struct {
+	key  string
+	each cty.Value
+}
+
+// instanceId returns id of the block instance generated for the given key, e.g. dms["billing"]
+func instanceId(id, key string) string {
+	return id + "[" + strconv.Quote(key) + "]"
+}
+
+// traversalKey returns key of the instance selected by the traversal step, e.g. ["billing"] or
+// .billing; ok is false if the key is not a static string
+func traversalKey(step hcl.Traverser) (string, bool) {
+	switch step := step.(type) {
+	case hcl.TraverseIndex:
+		if step.Key.Type() != cty.String || !step.Key.IsKnown() || step.Key.IsNull() {
+			return "", false
+		}
+		return step.Key.AsString(), true
+	case hcl.TraverseAttr:
+		return step.Name, true
+	}
+	return "", false
+}
+
+// blockBody returns body of the block without meta-arguments
+func blockBody(body *hclsyntax.Body) *hclsyntax.Body {
+	stripped := *body
+	stripped.Attributes = make(hclsyntax.Attributes)
+	for name, attr := range body.Attributes {
+		if !metaAttrs[name] {
+			stripped.Attributes[name] = attr
+		}
+	}
+	return &stripped
+}
+
+// forEachInstances evaluates for_each meta-argument of the block. Maps and objects give an
+// instance per element, lists and sets of strings give an instance per string, with the
+// string being both key and value. Returns false if the block has no for_each.
+func forEachInstances(b *hclsyntax.Block, ctx *hcl.EvalContext) ([]instance, bool, hcl.Diagnostics) {
+	attr, ok := b.Body.Attributes[forEachAttr]
+	if !ok {
+		return nil, false, nil
+	}
+
+	value, diag := attr.Expr.Value(ctx)
+	if diag.HasErrors() {
+		return nil, true, diag
+	}
+
+	invalid := func(detail string) hcl.Diagnostics {
+		return hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   detail,
+			Subject:  attr.Expr.Range().Ptr(),
+		}}
+	}
+
+	if value.IsNull() || !value.IsWhollyKnown() {
+		return nil, true, invalid("The for_each value must be known when the config is loaded")
+	}
+
+	ty := value.Type()
+	byKey := ty.IsMapType() || ty.IsObjectType()
+	if !byKey && !ty.IsListType() && !ty.IsSetType() && !ty.IsTupleType() {
+		return nil, true, invalid(fmt.Sprintf("The for_each value must be a map or a list of strings, got %s",
+			ty.FriendlyName()))
+	}
+
+	var result []instance
+	seen := make(map[string]bool)
+	for it := value.ElementIterator(); it.Next(); {
+		k, v := it.Element()
+
+		key := k
+		if !byKey {
+			key = v
+		}
+		key, err := convert.Convert(key, cty.String)
+		if err != nil || key.IsNull() {
+			return nil, true, invalid("The for_each list must contain strings only")
+		}
+
+		if seen[key.AsString()] {
+			return nil, true, invalid(fmt.Sprintf("Duplicate for_each element: %s", key.AsString()))
+		}
+		seen[key.AsString()] = true
+
+		result = append(result, instance{
+			key: key.AsString(),
+			each: cty.ObjectVal(map[string]cty.Value{
+				"key":   key,
+				"value": v,
+			}),
+		})
+	}
+
+	return result, true, nil
+}
+
+// instancesValue returns value of the generated blocks, addressable by key
+func instancesValue(values map[string]cty.Value) cty.Value {
+	if len(values) == 0 {
+		return cty.MapValEmpty(cty.DynamicPseudoType)
+	}
+	return cty.MapVal(values)
+}
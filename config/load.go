@@ -0,0 +1,553 @@
+package config
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/dbolotin/deadmanswitch/bctx"
+	"github.com/dbolotin/deadmanswitch/blocks"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Entry is a single block of the configuration
+type Entry struct {
+	Type  string
+	Block blocks.Block
+	Def   *hclsyntax.Block
+	// Context the block must be started with
+	Env *bctx.BEnv
+
+	// Identifies block definition; blocks with equal fingerprints are interchangeable
+	Fingerprint string
+
+	// Root config or module instance the block belongs to
+	scope *scope
+	// Whether the definition was decoded into the block, so its settings can be validated
+	decoded bool
+}
+
+// Graph is the set of interpreted blocks, ready to be started
+type Graph struct {
+	Source  *Source
+	Entries []*Entry
+	ById    map[string]*Entry
+	// Nil if state isn't persisted
+	State *StateConfig
+	// Nil if admin API is disabled
+	Admin *AdminConfig
+
+	scopes []*scope
+	// Definitions of settings blocks, by type
+	settingsRanges map[string]hcl.Range
+}
+
+// scope is the root config or an instance of a module. Blocks in a scope reference each other
+// by local names, while their ids are prefixed with the path of the module instance.
+type scope struct {
+	// Prefix of block ids, e.g. "billing." for blocks of module instance "billing"
+	prefix string
+	// Context with variables and locals of the scope
+	env *bctx.BEnv
+
+	// Values of blocks, by local name
+	values map[string]cty.Value
+	// Full ids of blocks, by local name; blocks with for_each have an id per instance
+	ids map[string][]string
+	// Local names of blocks with for_each
+	generated map[string]bool
+	// Values of module instances, by name; modules with for_each have an instance per key
+	modules map[string]cty.Value
+	// Scopes of module instances, by name, e.g. "billing" or "billing[\"eu\"]"
+	children map[string]*scope
+	// Scopes of module instances in order of declaration
+	instances []*scope
+	// Names of modules with for_each
+	generatedCalls map[string]bool
+	// Module blocks, instantiating child scopes
+	calls []*hclsyntax.Block
+}
+
+// Context for evaluation of block definitions in the scope
+func (s *scope) evalContext() *hcl.EvalContext {
+	variables := make(map[string]cty.Value)
+	for k, v := range s.env.DefaultVariables {
+		variables[k] = v
+	}
+	for k, v := range s.values {
+		variables[k] = v
+	}
+	variables[moduleBlockType] = cty.ObjectVal(s.modules)
+	return &hcl.EvalContext{
+		Variables: variables,
+		Functions: s.env.Functions,
+	}
+}
+
+// resolve returns ids of the blocks the traversal refers to, if any. Traversal of a block
+// with for_each refers to all its instances, unless it selects one of them by key.
+func (s *scope) resolve(t hcl.Traversal) []string {
+	target, name, rest := s, t.RootName(), t[1:]
+
+	if name == moduleBlockType {
+		// module.<instance>.<block>, or module.<instance>[<key>].<block> for modules with
+		// for_each
+		if len(t) < 2 {
+			return nil
+		}
+		instance, ok := t[1].(hcl.TraverseAttr)
+		if !ok {
+			return nil
+		}
+		childName, rest := instance.Name, t[2:]
+		if s.generatedCalls[instance.Name] {
+			if len(rest) == 0 {
+				return nil
+			}
+			key, ok := traversalKey(rest[0])
+			if !ok {
+				return nil
+			}
+			childName, rest = instanceId(instance.Name, key), rest[1:]
+		}
+		if len(rest) == 0 {
+			return nil
+		}
+		block, ok := rest[0].(hcl.TraverseAttr)
+		child, exists := s.children[childName]
+		if !ok || !exists {
+			return nil
+		}
+		target, name, rest = child, block.Name, rest[1:]
+	}
+
+	ids := target.ids[name]
+	if !target.generated[name] || len(rest) == 0 {
+		return ids
+	}
+
+	// Single instance, e.g. dms["billing"] or dms.billing
+	key, ok := traversalKey(rest[0])
+	if !ok {
+		return ids
+	}
+	id := instanceId(target.prefix+name, key)
+	for _, candidate := range ids {
+		if candidate == id {
+			return []string{id}
+		}
+	}
+	return nil
+}
+
+// Provides values for the variables of a scope
+type inputsFunc func(vars map[string]*variable, ctx *hcl.EvalContext) (map[string]inputValue, hcl.Diagnostics)
+
+type loader struct {
+	// Main context, without scope-specific variables
+	env      *bctx.BEnv
+	root     *Source
+	registry map[string]blocks.BlockFactory
+	graph    *Graph
+	// Number of unlabeled blocks having the same definition, by id
+	unlabeled map[string]int
+}
+
+// unlabeledId identifies unlabeled block by its definition, so that adding or removing other
+// blocks doesn't change its id; blocks with identical definitions are numbered in order
+func (l *loader) unlabeledId(prefix string, b *hclsyntax.Block) string {
+	hash := sha1.Sum(l.root.Bytes(b.Range()))
+	id := prefix + b.Type + "_" + hex.EncodeToString(hash[:4])
+	l.unlabeled[id]++
+	if n := l.unlabeled[id]; n > 1 {
+		id += "_" + strconv.Itoa(n)
+	}
+	return id
+}
+
+// Load interprets parsed top-level blocks, possibly originating from different files,
+// and merges them into a single graph. Blocks of module instances are added to the graph
+// with ids prefixed by the name of the instance.
+func Load(env *bctx.BEnv, src *Source) (*Graph, hcl.Diagnostics) {
+	l := &loader{
+		env:       env,
+		root:      src,
+		registry:  blocks.BlockRegistry(),
+		unlabeled: make(map[string]int),
+		graph: &Graph{
+			Source:         src,
+			ById:           make(map[string]*Entry),
+			settingsRanges: make(map[string]hcl.Range),
+		},
+	}
+
+	// First round of config interpretation
+
+	root, diag := l.declare(src, "", func(vars map[string]*variable, ctx *hcl.EvalContext) (map[string]inputValue, hcl.Diagnostics) {
+		return rootInputs(vars, src, ctx)
+	}, nil)
+	if diag.HasErrors() {
+		return nil, diag
+	}
+
+	diag = diag.Extend(l.checkReferences())
+	if diag.HasErrors() {
+		return nil, diag
+	}
+
+	// Second round of config interpretation
+
+	diag = diag.Extend(l.decode(root))
+	if diag.HasErrors() {
+		// Settings of the blocks decoded successfully are still validated, so that all errors
+		// are reported at once
+		return nil, diag.Extend(validateBlocks(l.graph.Entries))
+	}
+
+	return l.graph, diag
+}
+
+// declare evaluates variables and locals of the scope and registers all its blocks, including
+// blocks of nested module instances
+func (l *loader) declare(src *Source, prefix string, inputs inputsFunc, caller *hcl.Range) (*scope, hcl.Diagnostics) {
+	allDiag := hcl.Diagnostics{}
+
+	// Separating variables, locals, modules and settings from the blocks
+	var varDefs, localDefs, moduleDefs, settingsDefs, blockDefs []*hclsyntax.Block
+	for _, b := range src.Blocks {
+		switch b.Type {
+		case variableBlockType:
+			varDefs = append(varDefs, b)
+		case localsBlockType:
+			localDefs = append(localDefs, b)
+		case moduleBlockType:
+			moduleDefs = append(moduleDefs, b)
+		case stateBlockType, adminBlockType:
+			settingsDefs = append(settingsDefs, b)
+		default:
+			blockDefs = append(blockDefs, b)
+		}
+	}
+
+	allDiag = allDiag.Extend(l.decodeSettings(settingsDefs, prefix))
+	if allDiag.HasErrors() {
+		return nil, allDiag
+	}
+
+	// Evaluating variables and locals, that are visible in all expressions of the scope
+	valuesCtx := &hcl.EvalContext{
+		Variables: l.env.DefaultVariables,
+		Functions: l.env.Functions,
+	}
+	vars, diag := decodeVariables(varDefs)
+	allDiag = allDiag.Extend(diag)
+	if allDiag.HasErrors() {
+		return nil, allDiag
+	}
+	inputValues, diag := inputs(vars, valuesCtx)
+	allDiag = allDiag.Extend(diag)
+	if allDiag.HasErrors() {
+		return nil, allDiag
+	}
+	varValue, diag := variableValues(vars, inputValues, valuesCtx, caller)
+	allDiag = allDiag.Extend(diag)
+	if allDiag.HasErrors() {
+		return nil, allDiag
+	}
+	valuesCtx = valuesCtx.NewChild()
+	valuesCtx.Variables = map[string]cty.Value{"var": varValue}
+	localValue, diag := localValues(localDefs, valuesCtx)
+	allDiag = allDiag.Extend(diag)
+	if allDiag.HasErrors() {
+		return nil, allDiag
+	}
+
+	s := &scope{
+		prefix: prefix,
+		env: l.env.WithVariables(map[string]cty.Value{
+			"var":   varValue,
+			"local": localValue,
+		}),
+		values:         make(map[string]cty.Value),
+		ids:            make(map[string][]string),
+		generated:      make(map[string]bool),
+		modules:        make(map[string]cty.Value),
+		children:       make(map[string]*scope),
+		generatedCalls: make(map[string]bool),
+		calls:          moduleDefs,
+	}
+	l.graph.scopes = append(l.graph.scopes, s)
+
+	// Registering blocks; for_each may reference variables and locals only
+	forEachCtx := &hcl.EvalContext{
+		Variables: s.env.DefaultVariables,
+		Functions: s.env.Functions,
+	}
+	for _, b := range blockDefs {
+		rng := b.Range()
+
+		factory := l.registry[b.Type]
+		if factory == nil {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unknown block type",
+				Detail:   fmt.Sprintf("Unknown block: %s", b.Type),
+				Subject:  &b.TypeRange,
+				Context:  &rng,
+			})
+			continue
+		}
+
+		name := ""
+		baseId := l.unlabeledId(prefix, b)
+		if len(b.Labels) != 0 {
+			name = b.Labels[0]
+			baseId = prefix + name
+
+			if _, exist := s.env.DefaultVariables[name]; exist || name == moduleBlockType || name == eachVariable {
+				allDiag = allDiag.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Reserved variable name",
+					Detail:   fmt.Sprintf("Reserved variable name: %s", name),
+					Subject:  &b.LabelRanges[0],
+					Context:  &rng,
+				})
+				continue
+			}
+
+			if ids, exist := s.ids[name]; exist {
+				detail := fmt.Sprintf("Duplicate block identifier: %s", baseId)
+				if len(ids) != 0 {
+					detail += fmt.Sprintf("; previously defined at %s", l.graph.ById[ids[0]].Def.LabelRanges[0])
+				}
+				allDiag = allDiag.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate block identifier",
+					Detail:   detail,
+					Subject:  &b.LabelRanges[0],
+					Context:  &rng,
+				})
+				continue
+			}
+		}
+
+		instances, generated, diag := forEachInstances(b, forEachCtx)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+		if !generated {
+			instances = []instance{{}}
+		}
+
+		ids := []string{}
+		values := make(map[string]cty.Value)
+		for _, inst := range instances {
+			id, env := baseId, s.env
+			if generated {
+				id = instanceId(baseId, inst.key)
+				env = s.env.WithVariables(map[string]cty.Value{eachVariable: inst.each})
+			}
+
+			entry := &Entry{
+				Type:        b.Type,
+				Block:       factory(),
+				Def:         b,
+				Env:         env,
+				Fingerprint: b.Type + "\n" + string(l.root.Bytes(b.Range())),
+				scope:       s,
+			}
+			entry.Block.SetId(id)
+
+			if previous, exist := l.graph.ById[id]; exist {
+				allDiag = allDiag.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate block identifier",
+					Detail: fmt.Sprintf("Duplicate block identifier: %s; previously defined at %s",
+						id, previous.Def.LabelRanges[0]),
+					Subject: &b.LabelRanges[0],
+					Context: &rng,
+				})
+				continue
+			}
+
+			l.graph.Entries = append(l.graph.Entries, entry)
+			if name == "" {
+				continue
+			}
+			l.graph.ById[id] = entry
+			ids = append(ids, id)
+			values[inst.key] = entry.Block.GetValue(env)
+		}
+
+		if name == "" {
+			continue
+		}
+		s.ids[name] = ids
+		if generated {
+			s.generated[name] = true
+			s.values[name] = instancesValue(values)
+		} else if value, ok := values[""]; ok {
+			s.values[name] = value
+		}
+	}
+
+	if allDiag.HasErrors() {
+		return nil, allDiag
+	}
+
+	// Instantiating modules; module inputs may reference blocks of this scope and
+	// blocks of previously declared module instances
+	declared := make(map[string]bool)
+	for _, b := range moduleDefs {
+		rng := b.Range()
+
+		if len(b.Labels) != 1 {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing module name",
+				Detail:   "Module block must have a single label with the name of the module instance",
+				Subject:  b.DefRange().Ptr(),
+				Context:  &rng,
+			})
+			continue
+		}
+		name := b.Labels[0]
+
+		if declared[name] {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate module instance",
+				Detail:   fmt.Sprintf("Duplicate module instance: %s", name),
+				Subject:  &b.LabelRanges[0],
+				Context:  &rng,
+			})
+			continue
+		}
+
+		declared[name] = true
+
+		dir, diag := moduleDir(b)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+
+		instances, generated, diag := forEachInstances(b, forEachCtx)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+		if !generated {
+			instances = []instance{{}}
+		}
+
+		values := make(map[string]cty.Value)
+		for _, inst := range instances {
+			instanceName, callCtx := name, s.evalContext()
+			if generated {
+				instanceName = instanceId(name, inst.key)
+				callCtx = callCtx.NewChild()
+				callCtx.Variables = map[string]cty.Value{eachVariable: inst.each}
+			}
+
+			call := b
+			child, diag := l.declare(l.root.Modules[dir], prefix+instanceName+".",
+				func(vars map[string]*variable, _ *hcl.EvalContext) (map[string]inputValue, hcl.Diagnostics) {
+					return callInputs(vars, call, callCtx)
+				}, b.DefRange().Ptr())
+			allDiag = allDiag.Extend(diag)
+			if diag.HasErrors() {
+				continue
+			}
+
+			s.children[instanceName] = child
+			s.instances = append(s.instances, child)
+			values[inst.key] = cty.ObjectVal(child.values)
+		}
+
+		// Instances of a module may differ in their blocks, so they are collected into an
+		// object rather than a map
+		if generated {
+			s.generatedCalls[name] = true
+			s.modules[name] = cty.ObjectVal(values)
+		} else if value, ok := values[""]; ok {
+			s.modules[name] = value
+		}
+	}
+
+	if allDiag.HasErrors() {
+		return nil, allDiag
+	}
+
+	return s, allDiag
+}
+
+// checkReferences checks that referenced blocks are able to receive messages
+func (l *loader) checkReferences() hcl.Diagnostics {
+	allDiag := hcl.Diagnostics{}
+
+	check := func(s *scope, rng hcl.Range, traversals []hcl.Traversal) {
+		for _, t := range traversals {
+			for _, id := range s.resolve(t) {
+				target := l.graph.ById[id]
+				if _, ok := target.Block.(blocks.InputBlock); ok {
+					continue
+				}
+				subject := t.SourceRange()
+				allDiag = allDiag.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Block without input",
+					Detail: fmt.Sprintf("Block %s (%s) doesn't receive messages, so it can't be referenced",
+						id, target.Type),
+					Subject: &subject,
+					Context: &rng,
+				})
+			}
+		}
+	}
+
+	for _, e := range l.graph.Entries {
+		check(e.scope, e.Def.Range(), references(e.Def.Body))
+	}
+	for _, s := range l.graph.scopes {
+		for _, call := range s.calls {
+			check(s, call.Range(), references(call.Body))
+		}
+	}
+
+	return allDiag
+}
+
+// decode decodes definitions of all blocks of the scope and of its module instances
+func (l *loader) decode(s *scope) hcl.Diagnostics {
+	allDiag := hcl.Diagnostics{}
+
+	ctx := s.evalContext()
+	for _, e := range l.graph.Entries {
+		if e.scope != s {
+			continue
+		}
+		entryCtx := ctx
+		if each, ok := e.Env.DefaultVariables[eachVariable]; ok {
+			entryCtx = ctx.NewChild()
+			entryCtx.Variables = map[string]cty.Value{eachVariable: each}
+		}
+		body := blockBody(e.Def.Body)
+		diag := gohcl.DecodeBody(body, entryCtx, e.Block)
+		allDiag = allDiag.Extend(diag)
+		e.decoded = !diag.HasErrors()
+		allDiag = allDiag.Extend(processingOptions(e.Def, entryCtx, e.Block))
+		e.Fingerprint += referencedValues(body, e.Env, entryCtx)
+	}
+
+	for _, child := range s.instances {
+		allDiag = allDiag.Extend(l.decode(child))
+	}
+
+	return allDiag
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Top-level block instantiating a module
+const moduleBlockType = "module"
+
+// Attribute of the module block with the path to the module directory
+const moduleSourceAttr = "source"
+
+// moduleDir returns directory of the module, instantiated by the block. Relative paths are
+// resolved against the directory of the file the block is defined in.
+func moduleDir(b *hclsyntax.Block) (string, hcl.Diagnostics) {
+	attr, ok := b.Body.Attributes[moduleSourceAttr]
+	if !ok {
+		return "", hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing module source",
+			Detail:   "Module block must have the \"source\" attribute with the path to the module directory",
+			Subject:  b.DefRange().Ptr(),
+		}}
+	}
+
+	value, diag := attr.Expr.Value(nil)
+	if diag.HasErrors() {
+		return "", diag
+	}
+	if value.Type() != cty.String || value.IsNull() {
+		return "", hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid module source",
+			Detail:   "Module source must be a string literal",
+			Subject:  attr.Expr.Range().Ptr(),
+		}}
+	}
+
+	dir := value.AsString()
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(b.Range().Filename), dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// moduleInputs returns attributes of the module block, that set values of module variables
+func moduleInputs(b *hclsyntax.Block) (hcl.Attributes, hcl.Diagnostics) {
+	attrs, diag := b.Body.JustAttributes()
+	delete(attrs, moduleSourceAttr)
+	delete(attrs, forEachAttr)
+	return attrs, diag
+}
+
+// Evaluates module block attributes as values of module variables; for instances generated by
+// for_each, the context has the each variable
+func callInputs(vars map[string]*variable, call *hclsyntax.Block, ctx *hcl.EvalContext) (map[string]inputValue, hcl.Diagnostics) {
+	result := make(map[string]inputValue)
+	allDiag := hcl.Diagnostics{}
+
+	attrs, diag := moduleInputs(call)
+	allDiag = allDiag.Extend(diag)
+
+	for name, attr := range attrs {
+		if _, ok := vars[name]; !ok {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported argument",
+				Detail:   fmt.Sprintf("Module has no variable named %s", name),
+				Subject:  &attr.NameRange,
+			})
+			continue
+		}
+		value, diag := attr.Expr.Value(ctx)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+		result[name] = inputValue{value: value, rng: attr.Expr.Range().Ptr()}
+	}
+
+	return result, allDiag
+}
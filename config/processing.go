@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/dbolotin/deadmanswitch/bctx"
+	"github.com/dbolotin/deadmanswitch/blocks"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// Meta-arguments limiting concurrency of message processing
+const (
+	concurrencyAttr = "concurrency"
+	queueSizeAttr   = "queue_size"
+	overflowAttr    = "overflow"
+)
+
+// processingOptions evaluates processing meta-arguments of the block definition and passes
+// them to the block
+func processingOptions(def *hclsyntax.Block, ctx *hcl.EvalContext, block blocks.Block) hcl.Diagnostics {
+	allDiag := hcl.Diagnostics{}
+	rng := def.Range()
+
+	var attrs []*hclsyntax.Attribute
+	for _, name := range []string{concurrencyAttr, queueSizeAttr, overflowAttr} {
+		if attr, ok := def.Body.Attributes[name]; ok {
+			attrs = append(attrs, attr)
+		}
+	}
+	if len(attrs) == 0 {
+		return allDiag
+	}
+
+	processor, ok := block.(blocks.Processor)
+	if !ok {
+		for _, attr := range attrs {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported argument",
+				Detail:   fmt.Sprintf("Argument %s is not supported by %s blocks", attr.Name, def.Type),
+				Subject:  &attr.NameRange,
+				Context:  &rng,
+			})
+		}
+		return allDiag
+	}
+
+	opts := bctx.ProcessingOptions{Overflow: bctx.OverflowBlock}
+	var overflow string
+	for _, attr := range attrs {
+		var diag hcl.Diagnostics
+		switch attr.Name {
+		case concurrencyAttr:
+			diag = gohcl.DecodeExpression(attr.Expr, ctx, &opts.Concurrency)
+			if !diag.HasErrors() && opts.Concurrency < 1 {
+				diag = diag.Append(invalidProcessingOption(attr, rng, "Concurrency must be a positive number"))
+			}
+		case queueSizeAttr:
+			diag = gohcl.DecodeExpression(attr.Expr, ctx, &opts.QueueSize)
+			if !diag.HasErrors() && opts.QueueSize < 0 {
+				diag = diag.Append(invalidProcessingOption(attr, rng, "Queue size can't be negative"))
+			}
+		case overflowAttr:
+			diag = gohcl.DecodeExpression(attr.Expr, ctx, &overflow)
+			if diag.HasErrors() {
+				break
+			}
+			opts.Overflow = bctx.Overflow(overflow)
+			if err := opts.Overflow.Validate(); err != nil {
+				diag = diag.Append(invalidProcessingOption(attr, rng, fmt.Sprintf("Invalid overflow: %s", err)))
+			}
+		}
+		allDiag = allDiag.Extend(diag)
+	}
+
+	if !allDiag.HasErrors() && opts.Concurrency == 0 {
+		for _, attr := range attrs {
+			if attr.Name == concurrencyAttr {
+				continue
+			}
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Ineffective argument",
+				Detail:   fmt.Sprintf("Argument %s has no effect unless concurrency is limited", attr.Name),
+				Subject:  &attr.NameRange,
+				Context:  &rng,
+			})
+		}
+	}
+
+	processor.SetProcessingOptions(opts)
+	return allDiag
+}
+
+func invalidProcessingOption(attr *hclsyntax.Attribute, rng hcl.Range, detail string) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Invalid processing option",
+		Detail:   detail,
+		Subject:  attr.Expr.Range().Ptr(),
+		Context:  &rng,
+	}
+}
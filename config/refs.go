@@ -0,0 +1,48 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/dbolotin/deadmanswitch/bctx"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// references returns all variable traversals found in the body and its nested blocks
+func references(body *hclsyntax.Body) []hcl.Traversal {
+	var result []hcl.Traversal
+	for _, attr := range body.Attributes {
+		result = append(result, attr.Expr.Variables()...)
+	}
+	for _, b := range body.Blocks {
+		result = append(result, references(b.Body)...)
+	}
+	return result
+}
+
+// attrRange returns range of the attribute of the block, or of the block header if
+// attribute is not set explicitly
+func attrRange(def *hclsyntax.Block, name string) hcl.Range {
+	if attr, ok := def.Body.Attributes[name]; ok {
+		return attr.SrcRange
+	}
+	return def.DefRange()
+}
+
+// referencedValues renders values of default variables (like var.* and local.*) referenced by
+// the body, so a block is treated as changed when any of the values it depends on changes
+func referencedValues(body *hclsyntax.Body, env *bctx.BEnv, ctx *hcl.EvalContext) string {
+	var sb strings.Builder
+	for _, t := range references(body) {
+		if _, ok := env.DefaultVariables[t.RootName()]; !ok {
+			continue
+		}
+		value, diag := t.TraverseAbs(ctx)
+		if diag.HasErrors() {
+			continue
+		}
+		sb.WriteString("\n")
+		sb.WriteString(value.GoString())
+	}
+	return sb.String()
+}
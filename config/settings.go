@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// Top-level blocks configuring hookblock itself
+const (
+	stateBlockType = "state"
+	adminBlockType = "admin"
+)
+
+// StateConfig defines where blocks (e.g. timers) save their state, so it survives restarts
+type StateConfig struct {
+	// Path of the JSON file state is kept in
+	Path string `hcl:"path"`
+}
+
+// AdminConfig enables HTTP API to inspect and control timers
+type AdminConfig struct {
+	Address string `hcl:"address"`
+	// Bearer token required from clients of the API, if set
+	Token *string `hcl:"token,optional"`
+}
+
+// decodeSettings interprets settings blocks of the scope; each of them can only be given once,
+// in the root config
+func (l *loader) decodeSettings(defs []*hclsyntax.Block, prefix string) hcl.Diagnostics {
+	allDiag := hcl.Diagnostics{}
+
+	for _, b := range defs {
+		if prefix != "" {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Misplaced " + b.Type + " block",
+				Detail:   fmt.Sprintf("Block %s can only be used in the root config, not in modules", b.Type),
+				Subject:  b.DefRange().Ptr(),
+			})
+			continue
+		}
+		if previous, exist := l.graph.settingsRanges[b.Type]; exist {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate " + b.Type + " block",
+				Detail:   fmt.Sprintf("Block %s is already defined at %s", b.Type, previous),
+				Subject:  b.DefRange().Ptr(),
+			})
+			continue
+		}
+		l.graph.settingsRanges[b.Type] = b.DefRange()
+
+		switch b.Type {
+		case stateBlockType:
+			cfg := &StateConfig{}
+			diag := gohcl.DecodeBody(b.Body, nil, cfg)
+			allDiag = allDiag.Extend(diag)
+			if diag.HasErrors() {
+				continue
+			}
+			if cfg.Path == "" {
+				allDiag = allDiag.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid state path",
+					Detail:   "Path of the state file must not be empty",
+					Subject:  b.DefRange().Ptr(),
+				})
+				continue
+			}
+			l.graph.State = cfg
+
+		case adminBlockType:
+			cfg := &AdminConfig{}
+			diag := gohcl.DecodeBody(b.Body, nil, cfg)
+			allDiag = allDiag.Extend(diag)
+			if diag.HasErrors() {
+				continue
+			}
+			l.graph.Admin = cfg
+		}
+	}
+
+	return allDiag
+}
@@ -0,0 +1,350 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// Top-level blocks interpreted by the loader itself
+const (
+	variableBlockType = "variable"
+	localsBlockType   = "locals"
+)
+
+type variableDecl struct {
+	Name        string         `hcl:"name,label"`
+	Type        *hcl.Attribute `hcl:"type,optional"`
+	Default     *hcl.Attribute `hcl:"default,optional"`
+	Description *string        `hcl:"description,optional"`
+}
+
+type variable struct {
+	decl *variableDecl
+	def  *hclsyntax.Block
+	ty   cty.Type
+}
+
+// Value assigned to a variable outside of its declaration
+type inputValue struct {
+	value cty.Value
+	// Nil for values given on the command line
+	rng *hcl.Range
+}
+
+// ParseVarFiles reads values of variables from files consisting of "name = value" pairs.
+// Values from later files take precedence.
+func ParseVarFiles(parser *hclparse.Parser, paths []string) (hcl.Attributes, hcl.Diagnostics) {
+	result := make(hcl.Attributes)
+	allDiag := hcl.Diagnostics{}
+
+	for _, path := range paths {
+		f, diag := parser.ParseHCLFile(path)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+
+		attrs, diag := f.Body.JustAttributes()
+		allDiag = allDiag.Extend(diag)
+		for name, attr := range attrs {
+			result[name] = attr
+		}
+	}
+
+	return result, allDiag
+}
+
+func decodeVariables(defs []*hclsyntax.Block) (map[string]*variable, hcl.Diagnostics) {
+	result := make(map[string]*variable)
+	allDiag := hcl.Diagnostics{}
+
+	for _, b := range defs {
+		decl := &variableDecl{}
+		diag := gohcl.DecodeBody(b.Body, nil, decl)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+		if len(b.Labels) != 1 {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing variable name",
+				Detail:   "Variable block must have a single label with the name of the variable",
+				Subject:  b.DefRange().Ptr(),
+			})
+			continue
+		}
+		decl.Name = b.Labels[0]
+
+		if previous, exist := result[decl.Name]; exist {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate variable declaration",
+				Detail: fmt.Sprintf("Duplicate variable declaration: %s; previously declared at %s",
+					decl.Name, previous.def.LabelRanges[0]),
+				Subject: &b.LabelRanges[0],
+			})
+			continue
+		}
+
+		v := &variable{decl: decl, def: b, ty: cty.DynamicPseudoType}
+		if decl.Type != nil {
+			ty, diag := typeexpr.TypeConstraint(decl.Type.Expr)
+			allDiag = allDiag.Extend(diag)
+			if diag.HasErrors() {
+				continue
+			}
+			v.ty = ty
+		}
+		result[decl.Name] = v
+	}
+
+	return result, allDiag
+}
+
+// Collects values for the variables given in variable files and on the command line
+func rootInputs(vars map[string]*variable, src *Source, ctx *hcl.EvalContext) (map[string]inputValue, hcl.Diagnostics) {
+	result := make(map[string]inputValue)
+	allDiag := hcl.Diagnostics{}
+
+	for name, attr := range src.VarAttrs {
+		if _, ok := vars[name]; !ok {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Undeclared variable",
+				Detail:   fmt.Sprintf("Value is assigned to undeclared variable: %s", name),
+				Subject:  &attr.NameRange,
+			})
+			continue
+		}
+		value, diag := attr.Expr.Value(ctx)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+		result[name] = inputValue{value: value, rng: attr.Expr.Range().Ptr()}
+	}
+
+	for name, raw := range src.Vars {
+		v, ok := vars[name]
+		if !ok {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Undeclared variable",
+				Detail:   fmt.Sprintf("Value is assigned to undeclared variable on the command line: %s", name),
+			})
+			continue
+		}
+
+		// Primitive values are taken as is, complex ones are parsed as HCL expressions
+		if v.ty.IsPrimitiveType() || v.ty == cty.DynamicPseudoType {
+			result[name] = inputValue{value: cty.StringVal(raw)}
+			continue
+		}
+		expr, diag := hclsyntax.ParseExpression([]byte(raw), "<value for var."+name+">", hcl.Pos{Line: 1, Column: 1})
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+		value, diag := expr.Value(ctx)
+		allDiag = allDiag.Extend(diag)
+		if diag.HasErrors() {
+			continue
+		}
+		result[name] = inputValue{value: value}
+	}
+
+	return result, allDiag
+}
+
+// Computes final values of the variables, taking defaults for the ones not given as input
+// values. Missing required values are reported at the caller range, if given.
+func variableValues(vars map[string]*variable, inputs map[string]inputValue, ctx *hcl.EvalContext, caller *hcl.Range) (cty.Value, hcl.Diagnostics) {
+	values := make(map[string]cty.Value)
+	allDiag := hcl.Diagnostics{}
+
+	for name, v := range vars {
+		input, ok := inputs[name]
+		if !ok {
+			if v.decl.Default == nil {
+				subject := caller
+				if subject == nil {
+					subject = &v.def.LabelRanges[0]
+				}
+				allDiag = allDiag.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "No value for required variable",
+					Detail:   fmt.Sprintf("Variable %s has no default value, so its value must be set", name),
+					Subject:  subject,
+				})
+				continue
+			}
+			value, diag := v.decl.Default.Expr.Value(ctx)
+			allDiag = allDiag.Extend(diag)
+			if diag.HasErrors() {
+				continue
+			}
+			input = inputValue{value: value, rng: v.decl.Default.Expr.Range().Ptr()}
+		}
+
+		value, err := convert.Convert(input.value, v.ty)
+		if err != nil {
+			subject := input.rng
+			if subject == nil {
+				subject = &v.def.LabelRanges[0]
+			}
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for variable",
+				Detail: fmt.Sprintf("Unsuitable value for var.%s: %s; expected %s",
+					name, err, typeexpr.TypeString(v.ty)),
+				Subject: subject,
+			})
+			continue
+		}
+		values[name] = value
+	}
+
+	return cty.ObjectVal(values), allDiag
+}
+
+// Evaluates all locals blocks in the order of dependencies between the values
+func localValues(defs []*hclsyntax.Block, ctx *hcl.EvalContext) (cty.Value, hcl.Diagnostics) {
+	allDiag := hcl.Diagnostics{}
+	pending := make(map[string]*hcl.Attribute)
+	var order []string
+
+	for _, b := range defs {
+		if len(b.Labels) != 0 {
+			allDiag = allDiag.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unexpected locals label",
+				Detail:   "Locals block has no labels",
+				Subject:  &b.LabelRanges[0],
+			})
+			continue
+		}
+		attrs, diag := b.Body.JustAttributes()
+		allDiag = allDiag.Extend(diag)
+		for name, attr := range attrs {
+			if previous, exist := pending[name]; exist {
+				allDiag = allDiag.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate local value",
+					Detail: fmt.Sprintf("Duplicate local value: %s; previously defined at %s",
+						name, previous.NameRange),
+					Subject: &attr.NameRange,
+				})
+				continue
+			}
+			if diag := checkLocalReferences(attr); diag.HasErrors() {
+				allDiag = allDiag.Extend(diag)
+				continue
+			}
+			pending[name] = attr
+			order = append(order, name)
+		}
+	}
+
+	values := make(map[string]cty.Value)
+	evCtx := ctx.NewChild()
+	evCtx.Variables = map[string]cty.Value{}
+
+	// Evaluating values whose dependencies are already known, until no progress is possible
+	for progress := true; progress; {
+		progress = false
+		evCtx.Variables["local"] = cty.ObjectVal(values)
+
+		for _, name := range order {
+			attr, ok := pending[name]
+			if !ok || !localDependenciesKnown(attr, values) {
+				continue
+			}
+			value, diag := attr.Expr.Value(evCtx)
+			allDiag = allDiag.Extend(diag)
+			delete(pending, name)
+			progress = true
+			if diag.HasErrors() {
+				// Dependants evaluate to unknown values without reporting the same problem again
+				value = cty.DynamicVal
+			}
+			values[name] = value
+			evCtx.Variables["local"] = cty.ObjectVal(values)
+		}
+	}
+
+	for _, name := range order {
+		attr, ok := pending[name]
+		if !ok {
+			continue
+		}
+		allDiag = allDiag.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Unresolvable local value",
+			Detail:   fmt.Sprintf("Local value %s depends on itself or on a missing local value", name),
+			Subject:  &attr.NameRange,
+		})
+	}
+
+	return cty.ObjectVal(values), allDiag
+}
+
+func localDependenciesKnown(attr *hcl.Attribute, known map[string]cty.Value) bool {
+	for _, t := range attr.Expr.Variables() {
+		if t.RootName() != "local" {
+			continue
+		}
+		if name, ok := localName(t); ok {
+			if _, ok := known[name]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// localName returns name of the local value the traversal refers to, either as local.x or as
+// local["x"]; ok is false if the traversal refers to the whole local object or selects the value
+// with an expression
+func localName(t hcl.Traversal) (string, bool) {
+	if len(t) < 2 {
+		return "", false
+	}
+	switch step := t[1].(type) {
+	case hcl.TraverseAttr:
+		return step.Name, true
+	case hcl.TraverseIndex:
+		if step.Key.Type() == cty.String && step.Key.IsKnown() && !step.Key.IsNull() {
+			return step.Key.AsString(), true
+		}
+	}
+	return "", false
+}
+
+// checkLocalReferences rejects references to local values that can't be ordered by dependencies
+func checkLocalReferences(attr *hcl.Attribute) hcl.Diagnostics {
+	allDiag := hcl.Diagnostics{}
+	for _, t := range attr.Expr.Variables() {
+		if t.RootName() != "local" {
+			continue
+		}
+		if _, ok := localName(t); ok {
+			continue
+		}
+		rng := t.SourceRange()
+		allDiag = allDiag.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid local value reference",
+			Detail:   "Local values must be referenced by name, e.g. local.x or local[\"x\"]",
+			Subject:  &rng,
+		})
+	}
+	return allDiag
+}
@@ -0,0 +1,273 @@
+// Package cron parses cron expressions and computes times they match
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression with minute, hour, day of month, month and day of week
+// fields, evaluated in the given time zone
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// Whether day fields are unrestricted, changing how they are combined
+	domStar, dowStar bool
+	// Whether minute or hour field is a wildcard, so the schedule follows elapsed time rather
+	// than fixed times of day when clocks go back
+	wildcard bool
+	loc      *time.Location
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is Sunday as well as 0
+	dowField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses standard five-field cron expression, e.g. "0 3 * * mon-fri", or one of the
+// macros like "@daily"
+func Parse(expr string, loc *time.Location) (*Schedule, error) {
+	if macro, ok := macros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in cron expression, got %d", len(fields))
+	}
+
+	s := &Schedule{loc: loc}
+	var err error
+	if s.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	s.wildcard = strings.HasPrefix(fields[0], "*") || strings.HasPrefix(fields[1], "*")
+
+	return s, nil
+}
+
+// parseField parses comma-separated list of values, ranges and steps into a bit set
+func parseField(expr string, f field) (uint64, error) {
+	var result uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangeExpr = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field: %s", f.name, part)
+			}
+		}
+
+		var from, to int
+		switch {
+		case rangeExpr == "*" || rangeExpr == "?":
+			from, to = f.min, f.max
+		case strings.Contains(rangeExpr, "-"):
+			bounds := strings.SplitN(rangeExpr, "-", 2)
+			var err error
+			if from, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if to, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid range in %s field: %s", f.name, rangeExpr)
+			}
+		default:
+			var err error
+			if from, err = f.value(rangeExpr); err != nil {
+				return 0, err
+			}
+			to = from
+			// "5/15" means from 5 to the end with step 15
+			if step != 1 {
+				to = f.max
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			result |= 1 << uint(v)
+		}
+	}
+	return result, nil
+}
+
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s field: %s", f.name, s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s must be between %d and %d, got %d", f.name, f.min, f.max, v)
+	}
+	return v, nil
+}
+
+// Schedules not matching anything within this time, e.g. "0 0 30 2 *", are considered empty
+const searchLimit = 5 * 366 * 24 * time.Hour
+
+var errNoMatch = errors.New("cron expression matches no time")
+
+// Next returns the first matching time strictly after the given one, zero time if there is
+// none. As in cron(8), times skipped when clocks go forward match at the end of the gap, and
+// times repeated when clocks go back match once, unless minute or hour field is a wildcard.
+func (s *Schedule) Next(after time.Time) time.Time {
+	// Days are iterated by their local dates, represented in UTC to avoid DST adjustments
+	y, m, d := after.In(s.loc).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	limit := day.Add(searchLimit)
+
+	for day.Before(limit) {
+		if s.month&(1<<uint(day.Month())) == 0 {
+			day = time.Date(day.Year(), day.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.dayMatches(day) {
+			if t := s.nextOnDay(day, after); !t.IsZero() {
+				return t
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// nextOnDay returns the first matching time of the local day strictly after the given one,
+// zero time if there is none
+func (s *Schedule) nextOnDay(day time.Time, after time.Time) time.Time {
+	var next time.Time
+	earliest := func(t time.Time) {
+		if t.After(after) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	for hour := 0; hour < 24; hour++ {
+		if s.hour&(1<<uint(hour)) == 0 {
+			continue
+		}
+		for minute := 0; minute < 60; minute++ {
+			if s.minute&(1<<uint(minute)) == 0 {
+				continue
+			}
+
+			clock := day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+			times := s.occurrences(clock)
+			if len(times) == 0 {
+				times = []time.Time{s.gapEnd(clock)}
+			}
+			if len(times) > 1 && s.wildcard {
+				earliest(times[1])
+			}
+			// First occurrences only grow with the local time, so later ones can't be earlier
+			if times[0].After(after) {
+				earliest(times[0])
+				return next
+			}
+		}
+	}
+	return next
+}
+
+// occurrences returns instants the local time, represented in UTC, occurs at: none if it's
+// skipped when clocks go forward, two if it's repeated when clocks go back
+func (s *Schedule) occurrences(clock time.Time) []time.Time {
+	var result []time.Time
+	// Offsets in effect before and after a transition the local time may be affected by
+	for _, probe := range []time.Time{clock.Add(-24 * time.Hour), clock.Add(24 * time.Hour)} {
+		_, offset := probe.In(s.loc).Zone()
+		t := clock.Add(-time.Duration(offset) * time.Second).In(s.loc)
+		if !localClock(t).Equal(clock) || len(result) != 0 && result[0].Equal(t) {
+			continue
+		}
+		result = append(result, t)
+	}
+	if len(result) == 2 && result[1].Before(result[0]) {
+		result[0], result[1] = result[1], result[0]
+	}
+	return result
+}
+
+// gapEnd returns the instant clocks go forward at, skipping the local time
+func (s *Schedule) gapEnd(clock time.Time) time.Time {
+	for c := clock.Add(time.Minute); c.Before(clock.Add(48 * time.Hour)); c = c.Add(time.Minute) {
+		if times := s.occurrences(c); len(times) != 0 {
+			return times[0]
+		}
+	}
+	// Should never happen
+	return time.Date(clock.Year(), clock.Month(), clock.Day(), clock.Hour(), clock.Minute(), 0, 0, s.loc)
+}
+
+// localClock returns local time of the instant, represented in UTC
+func localClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// Validate checks that the schedule matches some time
+func (s *Schedule) Validate() error {
+	if s.Next(time.Now()).IsZero() {
+		return errNoMatch
+	}
+	return nil
+}
+
+// Day of month and day of week match any of them if both are restricted, as in crontab(5)
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,253 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("loading time zone %s: %s", name, err)
+	}
+	return loc
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"0 3 * * mon-fri", true},
+		{"*/15 9-17 1,15 jan-mar,dec SUN", true},
+		{"5/10 * * * *", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{"@HOURLY", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"* * * foo *", false},
+		{"@sometimes", false},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.expr, time.UTC)
+		if (err == nil) != test.valid {
+			t.Errorf("Parse(%q): got error %v, expected valid %v", test.expr, err, test.valid)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	newYork := mustLoad(t, "America/New_York")
+	lordHowe := mustLoad(t, "Australia/Lord_Howe")
+
+	tests := []struct {
+		name   string
+		expr   string
+		loc    *time.Location
+		after  string
+		expect []string
+	}{
+		{
+			name:   "every minute",
+			expr:   "* * * * *",
+			loc:    time.UTC,
+			after:  "2026-01-01T10:00:30Z",
+			expect: []string{"2026-01-01T10:01:00Z", "2026-01-01T10:02:00Z"},
+		},
+		{
+			name:   "strictly after",
+			expr:   "0 10 * * *",
+			loc:    time.UTC,
+			after:  "2026-01-01T10:00:00Z",
+			expect: []string{"2026-01-02T10:00:00Z"},
+		},
+		{
+			name:   "minute range",
+			expr:   "58-59,1 10 * * *",
+			loc:    time.UTC,
+			after:  "2026-01-01T10:00:00Z",
+			expect: []string{"2026-01-01T10:01:00Z", "2026-01-01T10:58:00Z", "2026-01-01T10:59:00Z", "2026-01-02T10:01:00Z"},
+		},
+		{
+			name:   "step",
+			expr:   "*/20 * * * *",
+			loc:    time.UTC,
+			after:  "2026-01-01T10:30:00Z",
+			expect: []string{"2026-01-01T10:40:00Z", "2026-01-01T11:00:00Z", "2026-01-01T11:20:00Z"},
+		},
+		{
+			name:   "step with start",
+			expr:   "5/25 * * * *",
+			loc:    time.UTC,
+			after:  "2026-01-01T10:00:00Z",
+			expect: []string{"2026-01-01T10:05:00Z", "2026-01-01T10:30:00Z", "2026-01-01T10:55:00Z", "2026-01-01T11:05:00Z"},
+		},
+		{
+			name:   "step within range",
+			expr:   "0 8-18/4 * * *",
+			loc:    time.UTC,
+			after:  "2026-01-01T09:00:00Z",
+			expect: []string{"2026-01-01T12:00:00Z", "2026-01-01T16:00:00Z", "2026-01-02T08:00:00Z"},
+		},
+		{
+			name:   "month and day names",
+			expr:   "0 0 * FEB,Apr sun",
+			loc:    time.UTC,
+			after:  "2026-01-15T00:00:00Z",
+			expect: []string{"2026-02-01T00:00:00Z", "2026-02-08T00:00:00Z", "2026-02-15T00:00:00Z", "2026-02-22T00:00:00Z", "2026-04-05T00:00:00Z"},
+		},
+		{
+			name:   "day name range",
+			expr:   "30 9 * * mon-fri",
+			loc:    time.UTC,
+			after:  "2026-01-02T10:00:00Z", // Friday
+			expect: []string{"2026-01-05T09:30:00Z", "2026-01-06T09:30:00Z"},
+		},
+		{
+			name:   "sunday as 7",
+			expr:   "0 12 * * 7",
+			loc:    time.UTC,
+			after:  "2026-01-01T00:00:00Z",
+			expect: []string{"2026-01-04T12:00:00Z", "2026-01-11T12:00:00Z"},
+		},
+		{
+			name:   "day of month or day of week",
+			expr:   "0 0 13 * fri",
+			loc:    time.UTC,
+			after:  "2026-02-01T00:00:00Z",
+			expect: []string{"2026-02-06T00:00:00Z", "2026-02-13T00:00:00Z", "2026-02-20T00:00:00Z", "2026-02-27T00:00:00Z", "2026-03-06T00:00:00Z", "2026-03-13T00:00:00Z"},
+		},
+		{
+			name:   "day of month with unrestricted day of week",
+			expr:   "0 0 13 * *",
+			loc:    time.UTC,
+			after:  "2026-02-01T00:00:00Z",
+			expect: []string{"2026-02-13T00:00:00Z", "2026-03-13T00:00:00Z"},
+		},
+		{
+			name:   "day of week with unrestricted day of month",
+			expr:   "0 0 ? * fri",
+			loc:    time.UTC,
+			after:  "2026-02-01T00:00:00Z",
+			expect: []string{"2026-02-06T00:00:00Z", "2026-02-13T00:00:00Z"},
+		},
+		{
+			name:   "leap day",
+			expr:   "0 0 29 2 *",
+			loc:    time.UTC,
+			after:  "2026-01-01T00:00:00Z",
+			expect: []string{"2028-02-29T00:00:00Z", "2032-02-29T00:00:00Z"},
+		},
+		{
+			name:   "time zone",
+			expr:   "0 9 * * *",
+			loc:    newYork,
+			after:  "2026-01-01T00:00:00Z",
+			expect: []string{"2026-01-01T14:00:00Z", "2026-01-02T14:00:00Z"},
+		},
+		{
+			name:   "skipped time runs when clocks go forward",
+			expr:   "30 2 * * *",
+			loc:    newYork,
+			after:  "2026-03-07T12:00:00-05:00",
+			expect: []string{"2026-03-08T03:00:00-04:00", "2026-03-09T02:30:00-04:00"},
+		},
+		{
+			name:   "several skipped times run once",
+			expr:   "0,30 2 * * *",
+			loc:    newYork,
+			after:  "2026-03-08T00:00:00-05:00",
+			expect: []string{"2026-03-08T03:00:00-04:00", "2026-03-09T02:00:00-04:00"},
+		},
+		{
+			name:   "skipped hour with wildcard",
+			expr:   "0 * * * *",
+			loc:    newYork,
+			after:  "2026-03-08T00:30:00-05:00",
+			expect: []string{"2026-03-08T01:00:00-05:00", "2026-03-08T03:00:00-04:00", "2026-03-08T04:00:00-04:00"},
+		},
+		{
+			name:   "skipped half hour",
+			expr:   "15 2 * * *",
+			loc:    lordHowe,
+			after:  "2026-10-03T12:00:00+10:30",
+			expect: []string{"2026-10-04T02:30:00+11:00", "2026-10-05T02:15:00+11:00"},
+		},
+		{
+			name:   "repeated time runs once when clocks go back",
+			expr:   "30 1 * * *",
+			loc:    newYork,
+			after:  "2026-10-31T12:00:00-04:00",
+			expect: []string{"2026-11-01T01:30:00-04:00", "2026-11-02T01:30:00-05:00"},
+		},
+		{
+			name:   "repeated hour with wildcard",
+			expr:   "0,30 * * * *",
+			loc:    newYork,
+			after:  "2026-11-01T00:45:00-04:00",
+			expect: []string{"2026-11-01T01:00:00-04:00", "2026-11-01T01:30:00-04:00", "2026-11-01T01:00:00-05:00", "2026-11-01T01:30:00-05:00", "2026-11-01T02:00:00-05:00"},
+		},
+		{
+			name:   "repeated hour with wildcard from its second occurrence",
+			expr:   "*/30 1 * * *",
+			loc:    newYork,
+			after:  "2026-11-01T01:10:00-05:00",
+			expect: []string{"2026-11-01T01:30:00-05:00", "2026-11-02T01:00:00-05:00"},
+		},
+	}
+
+	for _, test := range tests {
+		schedule, err := Parse(test.expr, test.loc)
+		if err != nil {
+			t.Errorf("%s: Parse(%q): %s", test.name, test.expr, err)
+			continue
+		}
+		after, err := time.Parse(time.RFC3339, test.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range test.expect {
+			expected, err := time.Parse(time.RFC3339, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := schedule.Next(after)
+			if !next.Equal(expected) {
+				t.Errorf("%s: Next(%s) = %s, expected %s", test.name, after, next, expected)
+				break
+			}
+			after = next
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"0 0 29 2 *", true},
+		{"0 0 31 4 *", false},
+		{"0 0 30 2 *", false},
+		{"0 0 30 2 mon", true},
+	}
+	for _, test := range tests {
+		schedule, err := Parse(test.expr, time.UTC)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", test.expr, err)
+			continue
+		}
+		if err := schedule.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%q): got error %v, expected valid %v", test.expr, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package funcs
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+var (
+	md5Hash    = md5.New
+	sha1Hash   = sha1.New
+	sha256Hash = sha256.New
+	sha512Hash = sha512.New
+)
+
+// MakeHashFunc creates a function returning hex-encoded digest of a string
+func MakeHashFunc(h func() hash.Hash) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "str", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			return cty.StringVal(hex.EncodeToString(digest(h, []byte(args[0].AsString())))), nil
+		},
+	})
+}
+
+// MakeBase64HashFunc creates a function returning Base64-encoded digest of a string
+func MakeBase64HashFunc(h func() hash.Hash) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "str", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			return cty.StringVal(base64.StdEncoding.EncodeToString(digest(h, []byte(args[0].AsString())))), nil
+		},
+	})
+}
+
+// MakeHmacFunc creates a function returning hex-encoded HMAC of a message, computed with
+// the given key
+func MakeHmacFunc(h func() hash.Hash) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "key", Type: cty.String},
+			{Name: "message", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			mac := hmac.New(h, []byte(args[0].AsString()))
+			mac.Write([]byte(args[1].AsString()))
+			return cty.StringVal(hex.EncodeToString(mac.Sum(nil))), nil
+		},
+	})
+}
+
+func digest(h func() hash.Hash, data []byte) []byte {
+	hh := h()
+	hh.Write(data)
+	return hh.Sum(nil)
+}
+
+// UUIDFunc generates a random (version 4) UUID on each call
+var UUIDFunc = function.New(&function.Spec{
+	Params: []function.Parameter{},
+	Type:   function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		var b [16]byte
+		_, err := rand.Read(b[:])
+		if err != nil {
+			return cty.UnknownVal(cty.String), err
+		}
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return cty.StringVal(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])), nil
+	},
+})
@@ -0,0 +1,141 @@
+// Package funcs contains functions available in config expressions
+package funcs
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+)
+
+// Functions giving a different result on each call
+var impureFunctions = map[string]function.Function{
+	"uuid":      UUIDFunc,
+	"timestamp": TimestampFunc,
+}
+
+// Functions returns the table of all functions, keyed by the name used in expressions
+func Functions() map[string]function.Function {
+	result := ConfigFunctions()
+	for name, f := range impureFunctions {
+		result[name] = f
+	}
+	return result
+}
+
+// ConfigFunctions returns the table of functions available in expressions evaluated when the
+// config is loaded, e.g. locals or block settings. Functions giving a different result on each
+// call fail there, as they would make blocks differ on every reload and restart them.
+func ConfigFunctions() map[string]function.Function {
+	result := pureFunctions()
+	for name := range impureFunctions {
+		result[name] = messageOnly(name)
+	}
+	return result
+}
+
+// messageOnly returns a function failing with an explanation, that the function of the given
+// name can only be used in expressions evaluated for each message
+func messageOnly(name string) function.Function {
+	return function.New(&function.Spec{
+		VarParam: &function.Parameter{Name: "args", Type: cty.DynamicPseudoType, AllowNull: true},
+		Type: func(args []cty.Value) (cty.Type, error) {
+			return cty.NilType, fmt.Errorf("%s() can only be used in expressions evaluated for each message, "+
+				"e.g. the ones referring to msg", name)
+		},
+	})
+}
+
+func pureFunctions() map[string]function.Function {
+	return map[string]function.Function{
+		// Strings
+		"chomp":        stdlib.ChompFunc,
+		"format":       stdlib.FormatFunc,
+		"formatlist":   stdlib.FormatListFunc,
+		"indent":       stdlib.IndentFunc,
+		"join":         stdlib.JoinFunc,
+		"lower":        stdlib.LowerFunc,
+		"regex":        stdlib.RegexFunc,
+		"regexall":     stdlib.RegexAllFunc,
+		"regexreplace": stdlib.RegexReplaceFunc,
+		"replace":      stdlib.ReplaceFunc,
+		"split":        stdlib.SplitFunc,
+		"strlen":       stdlib.StrlenFunc,
+		"strrev":       stdlib.ReverseFunc,
+		"substr":       stdlib.SubstrFunc,
+		"title":        stdlib.TitleFunc,
+		"trim":         stdlib.TrimFunc,
+		"trimprefix":   stdlib.TrimPrefixFunc,
+		"trimspace":    stdlib.TrimSpaceFunc,
+		"trimsuffix":   stdlib.TrimSuffixFunc,
+		"upper":        stdlib.UpperFunc,
+
+		// Numbers
+		"abs":      stdlib.AbsoluteFunc,
+		"ceil":     stdlib.CeilFunc,
+		"floor":    stdlib.FloorFunc,
+		"log":      stdlib.LogFunc,
+		"max":      stdlib.MaxFunc,
+		"min":      stdlib.MinFunc,
+		"parseint": stdlib.ParseIntFunc,
+		"pow":      stdlib.PowFunc,
+		"signum":   stdlib.SignumFunc,
+
+		// Collections
+		"chunklist":       stdlib.ChunklistFunc,
+		"coalesce":        stdlib.CoalesceFunc,
+		"coalescelist":    stdlib.CoalesceListFunc,
+		"compact":         stdlib.CompactFunc,
+		"concat":          stdlib.ConcatFunc,
+		"contains":        stdlib.ContainsFunc,
+		"distinct":        stdlib.DistinctFunc,
+		"element":         stdlib.ElementFunc,
+		"flatten":         stdlib.FlattenFunc,
+		"keys":            stdlib.KeysFunc,
+		"length":          stdlib.LengthFunc,
+		"lookup":          stdlib.LookupFunc,
+		"merge":           stdlib.MergeFunc,
+		"range":           stdlib.RangeFunc,
+		"reverse":         stdlib.ReverseListFunc,
+		"setintersection": stdlib.SetIntersectionFunc,
+		"setproduct":      stdlib.SetProductFunc,
+		"setsubtract":     stdlib.SetSubtractFunc,
+		"setunion":        stdlib.SetUnionFunc,
+		"slice":           stdlib.SliceFunc,
+		"sort":            stdlib.SortFunc,
+		"values":          stdlib.ValuesFunc,
+		"zipmap":          stdlib.ZipmapFunc,
+
+		// Encoding
+		"base64decode": Base64DecodeFunc,
+		"base64encode": Base64EncodeFunc,
+		"csvdecode":    stdlib.CSVDecodeFunc,
+		"jsondecode":   stdlib.JSONDecodeFunc,
+		"jsonencode":   stdlib.JSONEncodeFunc,
+		"urlencode":    URLEncodeFunc,
+
+		// Hashing
+		"md5":          MakeHashFunc(md5Hash),
+		"sha1":         MakeHashFunc(sha1Hash),
+		"sha256":       MakeHashFunc(sha256Hash),
+		"sha512":       MakeHashFunc(sha512Hash),
+		"base64sha256": MakeBase64HashFunc(sha256Hash),
+		"base64sha512": MakeBase64HashFunc(sha512Hash),
+		"hmacsha1":     MakeHmacFunc(sha1Hash),
+		"hmacsha256":   MakeHmacFunc(sha256Hash),
+		"hmacsha512":   MakeHmacFunc(sha512Hash),
+
+		// Date and time
+		"formatdate": stdlib.FormatDateFunc,
+		"timeadd":    stdlib.TimeAddFunc,
+
+		// Type conversion and error handling
+		"tobool":   MakeToFunc(cty.Bool),
+		"tonumber": MakeToFunc(cty.Number),
+		"tostring": MakeToFunc(cty.String),
+		"can":      tryfunc.CanFunc,
+		"try":      tryfunc.TryFunc,
+	}
+}
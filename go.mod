@@ -6,6 +6,7 @@ require (
 	github.com/gorilla/mux v1.7.4
 	github.com/hashicorp/hcl/v2 v2.6.0
 	github.com/prometheus/client_golang v1.6.0
-	github.com/zclconf/go-cty v1.2.0
+	github.com/zclconf/go-cty v1.8.4
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/yaml.v2 v2.2.5 // indirect
 )